@@ -3,88 +3,364 @@ package netbox2dns
 import (
 	"context"
 	"fmt"
+	"slices"
+	"sort"
+	"time"
 
+	log "github.com/golang/glog"
 	"google.golang.org/api/dns/v1"
 )
 
-// TODO: starting using dns.Changes to bundle up multiple changes into
-// a single transaction.  This should substantailly improve
-// performance when making multiple changes at once.
+// maxChangeSize is the largest number of additions plus deletions
+// that we'll send to Cloud DNS in a single dns.Change.  Cloud DNS
+// rejects changes that are too large, so bigger updates are split
+// into several changes and applied in order.
+const maxChangeSize = 1000
+
+// changePollInterval is how long to wait between checks while
+// waiting for a submitted dns.Change to finish.
+var changePollInterval = 2 * time.Second
 
 // CloudDNS implements talking to Google Cloud DNS, and provides
 // methods for fetching existing DNS entries, adding new entries, or
 // deleting old entries.
+//
+// Cloud DNS treats each name+type as a single rrset, which can only be
+// created or deleted as a whole.  So additions and removals are
+// applied to a local copy of each changed rrset, and Save() replaces
+// each changed rrset in Cloud DNS by deleting the old version and
+// adding the new one in the same dns.Change.
 type CloudDNS struct {
-	rrss *dns.ResourceRecordSetsService
+	rrss    *dns.ResourceRecordSetsService
+	changes *dns.ChangesService
+	rrsets  map[string]map[cloudDNSKey]*dns.ResourceRecordSet // Per zone, as last seen in Cloud DNS
+	pending map[string]map[cloudDNSKey]*dns.ResourceRecordSet // Per zone, the new version of each changed rrset
+	api     *apiCaller
+}
+
+// cloudDNSKey identifies a single rrset.  Names are compared in
+// canonical form, since Cloud DNS and Netbox may not agree on case.
+type cloudDNSKey struct {
+	name  string
+	rtype string
+}
+
+func newCloudDNSKey(name, rtype string) cloudDNSKey {
+	return cloudDNSKey{canonicalName(name), rtype}
 }
 
 // NewCloudDNS creates a new CloudDNS.
 func NewCloudDNS(ctx context.Context, cz *ConfigZone) (*CloudDNS, error) {
-	cd := &CloudDNS{}
-
 	dnsService, err := dns.NewService(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to connect to DNS: %v", err)
 	}
-	cd.rrss = dns.NewResourceRecordSetsService(dnsService)
 
-	return cd, nil
+	return newCloudDNS(dnsService), nil
+}
+
+// newCloudDNS creates a new CloudDNS using an existing dns.Service.
+func newCloudDNS(dnsService *dns.Service) *CloudDNS {
+	return &CloudDNS{
+		rrss:    dns.NewResourceRecordSetsService(dnsService),
+		changes: dns.NewChangesService(dnsService),
+		rrsets:  make(map[string]map[cloudDNSKey]*dns.ResourceRecordSet),
+		pending: make(map[string]map[cloudDNSKey]*dns.ResourceRecordSet),
+	}
+}
+
+// setAPICaller sets the apiCaller used to retry and rate limit calls
+// to Cloud DNS.
+func (cd *CloudDNS) setAPICaller(a *apiCaller) {
+	cd.api = a
 }
 
 // ImportZone imports all entries from the specified Google Cloud DNS zone.
-func (cd *CloudDNS) ImportZone(cfg *ConfigZone) (*Zone, error) {
+func (cd *CloudDNS) ImportZone(ctx context.Context, cfg *ConfigZone) (*Zone, error) {
 	zone := &Zone{
 		Name:          cfg.Name,
 		ZoneName:      cfg.ZoneName,
 		Project:       cfg.Project,
 		TTL:           cfg.TTL,
 		DeleteEntries: cfg.DeleteEntries,
+		IgnoreTTL:     cfg.IgnoreTTL,
 		Records:       make(map[string][]*Record),
 	}
 
-	call := cd.rrss.List(zone.Project, cfg.ZoneName)
-	rrs, err := call.Do()
+	rrsets := make(map[cloudDNSKey]*dns.ResourceRecordSet)
+	err := cd.api.call(ctx, "list records in "+cfg.Name, func() error {
+		// Start over from the first page on each attempt.
+		zone.Records = make(map[string][]*Record)
+		clear(rrsets)
+		call := cd.rrss.List(zone.Project, cfg.ZoneName)
+		return call.Pages(ctx, func(rrs *dns.ResourceRecordSetsListResponse) error {
+			for _, r := range rrs.Rrsets {
+				rrsets[newCloudDNSKey(r.Name, r.Type)] = copyRrset(r)
+				rr := Record{
+					Name:    r.Name,
+					Type:    r.Type,
+					TTL:     r.Ttl,
+					Rrdatas: r.Rrdatas,
+				}
+				zone.AddRecord(&rr)
+			}
+			return nil
+		})
+	})
 	if err != nil {
 		return nil, fmt.Errorf("Unable to get zone: %v", err)
 	}
 
-	for _, r := range rrs.Rrsets {
-		rr := Record{
-			Name:    r.Name,
-			Type:    r.Type,
-			TTL:     r.Ttl,
-			Rrdatas: r.Rrdatas,
-		}
-		zone.AddRecord(&rr)
-	}
+	cd.rrsets[cfg.Name] = rrsets
+	delete(cd.pending, cfg.Name)
 
 	return zone, nil
 }
 
-// WriteRecord adds a record to Google Cloud DNS.
-func (cd *CloudDNS) WriteRecord(cz *ConfigZone, r *Record) error {
-	c := cd.rrss.Create(cz.Project, cz.ZoneName, &dns.ResourceRecordSet{
+// discardChanges drops all changes to a zone that haven't been saved.
+func (cd *CloudDNS) discardChanges(cz *ConfigZone) {
+	delete(cd.pending, cz.Name)
+}
+
+// copyRrset returns a copy of a dns.ResourceRecordSet with just the
+// fields that netbox2dns uses.
+func copyRrset(r *dns.ResourceRecordSet) *dns.ResourceRecordSet {
+	return &dns.ResourceRecordSet{
 		Name:    r.Name,
 		Type:    r.Type,
-		Ttl:     r.TTL,
-		Rrdatas: r.Rrdatas,
+		Ttl:     r.Ttl,
+		Rrdatas: slices.Clone(r.Rrdatas),
+	}
+}
+
+// sameRrset returns true if two rrsets have the same TTL and the same
+// rrdatas, in any order.  Nil means that the rrset doesn't exist.
+func sameRrset(a, b *dns.ResourceRecordSet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Ttl != b.Ttl || len(a.Rrdatas) != len(b.Rrdatas) {
+		return false
+	}
+	for _, rrdata := range a.Rrdatas {
+		if !slices.Contains(b.Rrdatas, rrdata) {
+			return false
+		}
+	}
+	return true
+}
+
+// pendingRrset returns the new version of the rrset for a record,
+// starting from the version in Cloud DNS if it hasn't been changed
+// yet.  If the zone wasn't imported first, then the rrset is assumed
+// to contain exactly the records that are removed from it.
+func (cd *CloudDNS) pendingRrset(cz *ConfigZone, r *Record, removing bool) *dns.ResourceRecordSet {
+	key := newCloudDNSKey(r.Name, r.Type)
+	pending := cd.pending[cz.Name]
+	if pending == nil {
+		pending = make(map[cloudDNSKey]*dns.ResourceRecordSet)
+		cd.pending[cz.Name] = pending
+	}
+	if rrset := pending[key]; rrset != nil {
+		return rrset
+	}
+
+	rrsets := cd.rrsets[cz.Name]
+	if rrsets == nil {
+		rrsets = make(map[cloudDNSKey]*dns.ResourceRecordSet)
+		cd.rrsets[cz.Name] = rrsets
+	}
+	if rrsets[key] == nil && removing {
+		rrsets[key] = &dns.ResourceRecordSet{Name: r.Name, Type: r.Type, Ttl: r.TTL, Rrdatas: slices.Clone(r.Rrdatas)}
+	}
+
+	rrset := &dns.ResourceRecordSet{Name: r.Name, Type: r.Type, Ttl: r.TTL}
+	if old := rrsets[key]; old != nil {
+		rrset = copyRrset(old)
+	}
+	pending[key] = rrset
+	return rrset
+}
+
+// WriteRecord adds a record to the local copy of its rrset.  Note that
+// this won't actually be sent to Cloud DNS until 'Save()' is called.
+func (cd *CloudDNS) WriteRecord(ctx context.Context, cz *ConfigZone, r *Record) error {
+	rrset := cd.pendingRrset(cz, r, false)
+	rrset.Ttl = r.TTL
+	for _, rrdata := range r.Rrdatas {
+		if !slices.Contains(rrset.Rrdatas, rrdata) {
+			rrset.Rrdatas = append(rrset.Rrdatas, rrdata)
+		}
+	}
+	return nil
+}
+
+// RemoveRecord removes a record from the local copy of its rrset.
+// Other records in the same rrset are left alone.  Note that this
+// won't actually be sent to Cloud DNS until 'Save()' is called.
+func (cd *CloudDNS) RemoveRecord(ctx context.Context, cz *ConfigZone, r *Record) error {
+	rrset := cd.pendingRrset(cz, r, true)
+	rrset.Rrdatas = slices.DeleteFunc(rrset.Rrdatas, func(rrdata string) bool {
+		return slices.Contains(r.Rrdatas, rrdata)
 	})
-	_, err := c.Do()
-	return err
+	return nil
 }
 
-// RemoveRecord removes a DNS entry from Google Cloud DNS.
-//
-// TODO: implement
-func (cd *CloudDNS) RemoveRecord(cz *ConfigZone, r *Record) error {
-	d := cd.rrss.Delete(cz.Project, cz.ZoneName, r.Name, r.Type)
-	_, err := d.Do()
+// Save sends all changed rrsets for a zone to Cloud DNS and waits for
+// the changes to finish.  Each changed rrset is replaced by deleting
+// the old version and adding the new version in the same dns.Change,
+// so Cloud DNS applies it atomically.  Small updates are applied as a
+// single atomic transaction; larger updates are split into multiple
+// changes of at most maxChangeSize records each.  Changes are only
+// retried if Cloud DNS rejected them for rate limiting, since any other
+// failure may have happened after the change was applied.
+func (cd *CloudDNS) Save(ctx context.Context, cz *ConfigZone) error {
+	pending := cd.pending[cz.Name]
+	if len(pending) == 0 {
+		return nil
+	}
+	delete(cd.pending, cz.Name)
+	rrsets := cd.rrsets[cz.Name]
+
+	keys := make([]cloudDNSKey, 0, len(pending))
+	for k := range pending {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name == keys[j].name {
+			return keys[i].rtype < keys[j].rtype
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	c := &dns.Change{}
+	for _, k := range keys {
+		old, rrset := rrsets[k], pending[k]
+		if len(rrset.Rrdatas) == 0 {
+			rrset = nil
+		}
+		if sameRrset(old, rrset) {
+			continue
+		}
+		if old != nil {
+			c.Deletions = append(c.Deletions, old)
+		}
+		if rrset != nil {
+			c.Additions = append(c.Additions, rrset)
+		}
+	}
+	if len(c.Deletions)+len(c.Additions) == 0 {
+		return nil
+	}
+
+	chunks := splitChange(c, maxChangeSize)
+	for i, chunk := range chunks {
+		log.Infof("Sending change %d/%d to zone %q: %d deletions, %d additions", i+1, len(chunks), cz.Name, len(chunk.Deletions), len(chunk.Additions))
+		var result *dns.Change
+		err := cd.api.call(ctx, "change "+cz.Name, func() (err error) {
+			result, err = cd.changes.Create(cz.Project, cz.ZoneName, chunk).Context(ctx).Do()
+			if err != nil && !isRateLimited(err) {
+				// A change isn't idempotent; if it was
+				// applied but the reply was lost, then
+				// sending it again would fail.
+				return &permanentError{err}
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to apply change %d/%d to zone %q: %v", i+1, len(chunks), cz.Name, err)
+		}
+		err = cd.waitForChange(ctx, cz, result)
+		if err != nil {
+			return err
+		}
 
-	return err
+		for _, d := range chunk.Deletions {
+			delete(rrsets, newCloudDNSKey(d.Name, d.Type))
+		}
+		for _, a := range chunk.Additions {
+			rrsets[newCloudDNSKey(a.Name, a.Type)] = a
+		}
+	}
+	return nil
 }
 
-// Save flushes changes to Cloud DNS.  This is a no-op at the moment,
-// but we'll eventually batch queries together for performance.
-func (cd *CloudDNS) Save(cz *ConfigZone) error {
+// waitForChange polls Cloud DNS until the specified change is no
+// longer pending, or until ctx is done.
+func (cd *CloudDNS) waitForChange(ctx context.Context, cz *ConfigZone, c *dns.Change) error {
+	var err error
+	for c.Status == "pending" {
+		select {
+		case <-time.After(changePollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("Gave up waiting for change %q in zone %q: %v", c.Id, cz.Name, ctx.Err())
+		}
+		id := c.Id
+		err = cd.api.call(ctx, "check change in "+cz.Name, func() (err error) {
+			c, err = cd.changes.Get(cz.Project, cz.ZoneName, id).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to check status of change in zone %q: %v", cz.Name, err)
+		}
+	}
+	if c.Status != "done" {
+		return fmt.Errorf("Change %q in zone %q finished with unexpected status %q", c.Id, cz.Name, c.Status)
+	}
 	return nil
 }
+
+// splitChange breaks a single dns.Change into a list of changes with
+// no more than `size` additions plus deletions each.  The deletion and
+// addition that replace the same rrset are always kept in the same
+// change, so Cloud DNS never sees the rrset half-replaced.  Otherwise,
+// deletions are placed before additions, so a name is freed up before
+// a record of another type is added for it.
+func splitChange(c *dns.Change, size int) []*dns.Change {
+	if len(c.Additions)+len(c.Deletions) <= size {
+		return []*dns.Change{c}
+	}
+
+	additions := make(map[cloudDNSKey]*dns.ResourceRecordSet)
+	for _, a := range c.Additions {
+		additions[newCloudDNSKey(a.Name, a.Type)] = a
+	}
+
+	// Pure deletions, then replacements, then pure additions.
+	var deletions, replacements []*dns.Change
+	for _, d := range c.Deletions {
+		k := newCloudDNSKey(d.Name, d.Type)
+		if a := additions[k]; a != nil {
+			replacements = append(replacements, &dns.Change{Deletions: []*dns.ResourceRecordSet{d}, Additions: []*dns.ResourceRecordSet{a}})
+			delete(additions, k)
+		} else {
+			deletions = append(deletions, &dns.Change{Deletions: []*dns.ResourceRecordSet{d}})
+		}
+	}
+	units := append(deletions, replacements...)
+	for _, a := range c.Additions {
+		if additions[newCloudDNSKey(a.Name, a.Type)] != nil {
+			units = append(units, &dns.Change{Additions: []*dns.ResourceRecordSet{a}})
+		}
+	}
+
+	chunks := []*dns.Change{}
+	chunk := &dns.Change{}
+	count := 0
+	for _, u := range units {
+		n := len(u.Deletions) + len(u.Additions)
+		if count > 0 && count+n > size {
+			chunks = append(chunks, chunk)
+			chunk = &dns.Change{}
+			count = 0
+		}
+		chunk.Deletions = append(chunk.Deletions, u.Deletions...)
+		chunk.Additions = append(chunk.Additions, u.Additions...)
+		count += n
+	}
+	if count > 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
@@ -0,0 +1,252 @@
+package netbox2dns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/dns/v1"
+	"google.golang.org/api/option"
+)
+
+func makeChange(deletions, additions int) *dns.Change {
+	c := &dns.Change{}
+	for i := 0; i < deletions; i++ {
+		c.Deletions = append(c.Deletions, &dns.ResourceRecordSet{Name: fmt.Sprintf("d%d.example.com.", i)})
+	}
+	for i := 0; i < additions; i++ {
+		c.Additions = append(c.Additions, &dns.ResourceRecordSet{Name: fmt.Sprintf("a%d.example.com.", i)})
+	}
+	return c
+}
+
+func TestSplitChange(t *testing.T) {
+	tests := []struct {
+		deletions, additions, size int
+		want                       [][2]int // {deletions, additions} per chunk
+	}{
+		{0, 1, 10, [][2]int{{0, 1}}},
+		{5, 5, 10, [][2]int{{5, 5}}},
+		{5, 6, 10, [][2]int{{5, 5}, {0, 1}}},
+		{12, 3, 5, [][2]int{{5, 0}, {5, 0}, {2, 3}}},
+		{0, 10, 5, [][2]int{{0, 5}, {0, 5}}},
+	}
+
+	for _, test := range tests {
+		got := splitChange(makeChange(test.deletions, test.additions), test.size)
+		if len(got) != len(test.want) {
+			t.Errorf("splitChange(%d, %d, %d): got %d chunks, want %d", test.deletions, test.additions, test.size, len(got), len(test.want))
+			continue
+		}
+		for i, c := range got {
+			if len(c.Deletions) != test.want[i][0] || len(c.Additions) != test.want[i][1] {
+				t.Errorf("splitChange(%d, %d, %d): chunk %d got {%d, %d}, want %v", test.deletions, test.additions, test.size, i, len(c.Deletions), len(c.Additions), test.want[i])
+			}
+		}
+	}
+}
+
+func TestCloudDNSSave(t *testing.T) {
+	var created []*dns.Change
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/changes"):
+			c := &dns.Change{}
+			if err := json.NewDecoder(r.Body).Decode(c); err != nil {
+				t.Errorf("Unable to decode change: %v", err)
+			}
+			created = append(created, c)
+			json.NewEncoder(w).Encode(&dns.Change{Id: "1", Status: "pending"})
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/changes/1"):
+			json.NewEncoder(w).Encode(&dns.Change{Id: "1", Status: "done"})
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	svc, err := dns.NewService(context.Background(), option.WithEndpoint(ts.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("Unable to create DNS service: %v", err)
+	}
+	cd := newCloudDNS(svc)
+	oldChangePollInterval := changePollInterval
+	t.Cleanup(func() { changePollInterval = oldChangePollInterval })
+	changePollInterval = 0
+
+	cz := &ConfigZone{Name: "example.com", ZoneName: "example-com", Project: "p"}
+	cd.RemoveRecord(context.Background(), cz, &Record{Name: "old.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.1"}})
+	cd.WriteRecord(context.Background(), cz, &Record{Name: "new.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.2"}})
+	cd.WriteRecord(context.Background(), cz, &Record{Name: "2.0.0.10.in-addr.arpa.", Type: "PTR", TTL: 300, Rrdatas: []string{"new.example.com."}})
+
+	if len(created) != 0 {
+		t.Fatalf("Changes sent before Save(): got %d, want 0", len(created))
+	}
+
+	err = cd.Save(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("Save() returned error: %v", err)
+	}
+
+	if len(created) != 1 {
+		t.Fatalf("Save() sent %d changes, want 1", len(created))
+	}
+	if len(created[0].Deletions) != 1 || len(created[0].Additions) != 2 {
+		t.Errorf("Save() sent %d deletions and %d additions, want 1 and 2", len(created[0].Deletions), len(created[0].Additions))
+	}
+
+	// A second Save() with nothing queued should be a no-op.
+	err = cd.Save(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("Save() returned error: %v", err)
+	}
+	if len(created) != 1 {
+		t.Errorf("Empty Save() sent a change")
+	}
+}
+
+func TestCloudDNSSaveTimeout(t *testing.T) {
+	// A change that never finishes.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&dns.Change{Id: "1", Status: "pending"})
+	}))
+	defer ts.Close()
+
+	svc, err := dns.NewService(context.Background(), option.WithEndpoint(ts.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("Unable to create DNS service: %v", err)
+	}
+	cd := newCloudDNS(svc)
+	oldChangePollInterval := changePollInterval
+	t.Cleanup(func() { changePollInterval = oldChangePollInterval })
+	changePollInterval = 10 * time.Millisecond
+
+	cz := &ConfigZone{Name: "example.com", ZoneName: "example-com", Project: "p"}
+	cd.WriteRecord(context.Background(), cz, &Record{Name: "new.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.2"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = cd.Save(ctx, cz)
+	if err == nil {
+		t.Fatalf("Save() of a change that never finishes succeeded, want error")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("Save() took %v to notice the timeout", time.Since(start))
+	}
+}
+
+func TestSplitChangeReplacements(t *testing.T) {
+	// 3 replacements of 2 records each don't fit evenly into changes
+	// of size 3, so each change gets just one replacement.
+	c := &dns.Change{}
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("r%d.example.com.", i)
+		c.Deletions = append(c.Deletions, &dns.ResourceRecordSet{Name: name, Type: "A", Rrdatas: []string{"10.0.0.1"}})
+		c.Additions = append(c.Additions, &dns.ResourceRecordSet{Name: name, Type: "A", Rrdatas: []string{"10.0.0.2"}})
+	}
+
+	got := splitChange(c, 3)
+	if len(got) != 3 {
+		t.Fatalf("splitChange() got %d chunks, want 3", len(got))
+	}
+	for i, chunk := range got {
+		if len(chunk.Deletions) != 1 || len(chunk.Additions) != 1 || chunk.Deletions[0].Name != chunk.Additions[0].Name {
+			t.Errorf("splitChange() chunk %d doesn't hold a single replacement: %+v", i, chunk)
+		}
+	}
+}
+
+func TestCloudDNSRrsets(t *testing.T) {
+	var created []*dns.Change
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/rrsets"):
+			json.NewEncoder(w).Encode(&dns.ResourceRecordSetsListResponse{Rrsets: []*dns.ResourceRecordSet{
+				{Name: "router1.example.com.", Type: "A", Ttl: 300, Rrdatas: []string{"10.0.0.1", "10.0.0.2"}},
+				{Name: "router1.example.com.", Type: "AAAA", Ttl: 300, Rrdatas: []string{"2001:db8::1"}},
+				{Name: "old.example.com.", Type: "A", Ttl: 300, Rrdatas: []string{"10.0.0.3"}},
+				{Name: "same.example.com.", Type: "A", Ttl: 300, Rrdatas: []string{"10.0.0.5"}},
+			}})
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/changes"):
+			c := &dns.Change{}
+			if err := json.NewDecoder(r.Body).Decode(c); err != nil {
+				t.Errorf("Unable to decode change: %v", err)
+			}
+			created = append(created, c)
+			json.NewEncoder(w).Encode(&dns.Change{Id: "1", Status: "done"})
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	svc, err := dns.NewService(context.Background(), option.WithEndpoint(ts.URL), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("Unable to create DNS service: %v", err)
+	}
+	cd := newCloudDNS(svc)
+
+	ctx := context.Background()
+	cz := &ConfigZone{Name: "example.com", ZoneName: "example-com", Project: "p", TTL: 300}
+	_, err = cd.ImportZone(ctx, cz)
+	if err != nil {
+		t.Fatalf("ImportZone() returned error: %v", err)
+	}
+
+	// Swap one address of a multi-homed host, add a second AAAA
+	// with a new TTL, remove a whole rrset, and remove and re-add
+	// an unchanged record.
+	cd.RemoveRecord(ctx, cz, &Record{Name: "router1.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.2"}})
+	cd.WriteRecord(ctx, cz, &Record{Name: "router1.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.4"}})
+	cd.WriteRecord(ctx, cz, &Record{Name: "router1.example.com.", Type: "AAAA", TTL: 600, Rrdatas: []string{"2001:db8::2"}})
+	cd.RemoveRecord(ctx, cz, &Record{Name: "old.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.3"}})
+	cd.RemoveRecord(ctx, cz, &Record{Name: "same.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.5"}})
+	cd.WriteRecord(ctx, cz, &Record{Name: "same.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.5"}})
+
+	err = cd.Save(ctx, cz)
+	if err != nil {
+		t.Fatalf("Save() returned error: %v", err)
+	}
+	if len(created) != 1 {
+		t.Fatalf("Save() sent %d changes, want 1", len(created))
+	}
+
+	format := func(rrsets []*dns.ResourceRecordSet) string {
+		s := []string{}
+		for _, r := range rrsets {
+			s = append(s, fmt.Sprintf("%s %s %d %v", r.Name, r.Type, r.Ttl, r.Rrdatas))
+		}
+		return strings.Join(s, "; ")
+	}
+	wantDeletions := "old.example.com. A 300 [10.0.0.3]; router1.example.com. A 300 [10.0.0.1 10.0.0.2]; router1.example.com. AAAA 300 [2001:db8::1]"
+	wantAdditions := "router1.example.com. A 300 [10.0.0.1 10.0.0.4]; router1.example.com. AAAA 600 [2001:db8::1 2001:db8::2]"
+	if got := format(created[0].Deletions); got != wantDeletions {
+		t.Errorf("Save() deletions wrong;\n got %s\nwant %s", got, wantDeletions)
+	}
+	if got := format(created[0].Additions); got != wantAdditions {
+		t.Errorf("Save() additions wrong;\n got %s\nwant %s", got, wantAdditions)
+	}
+
+	// Later changes start from what was saved.
+	cd.RemoveRecord(ctx, cz, &Record{Name: "router1.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.4"}})
+	err = cd.Save(ctx, cz)
+	if err != nil {
+		t.Fatalf("Save() returned error: %v", err)
+	}
+	if got := format(created[1].Deletions); got != "router1.example.com. A 300 [10.0.0.1 10.0.0.4]" {
+		t.Errorf("Second Save() deletions wrong; got %s", got)
+	}
+	if got := format(created[1].Additions); got != "router1.example.com. A 300 [10.0.0.1]" {
+		t.Errorf("Second Save() additions wrong; got %s", got)
+	}
+}
@@ -4,140 +4,338 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	log "github.com/golang/glog"
 	nb "github.com/scottlaird/netbox2dns"
 )
 
 var (
-	config = flag.String("config", "", "Path of a config file, with a .yaml, .json, or .cue extension")
+	config  = flag.String("config", "", "Path of a config file, with a .yaml, .json, or .cue extension")
+	force   = flag.Bool("force", false, "Ignore the deletion and address count limits in the safety config")
+	output  = flag.String("output", "text", "Format for listing changes: text, json, or yaml")
+	out     = flag.String("out", "", "File to write a plan to, for 'plan'")
+	timeout = flag.Duration("timeout", 0, "Give up after this long, like 10m; for 'serve', this applies to each sync.  0 means no limit")
 )
 
 func usage() {
-	fmt.Printf("Usage: netbox2dns [--config=FILE] diff|push\n")
+	fmt.Printf("Usage: netbox2dns [--config=FILE] [--timeout=DURATION] [--force] [--output=text|json|yaml] diff|push\n")
+	fmt.Printf("       netbox2dns [--config=FILE] [--timeout=DURATION] [--force] [--output=text|json|yaml] --out=PLAN plan\n")
+	fmt.Printf("       netbox2dns [--config=FILE] [--timeout=DURATION] [--output=text|json|yaml] apply PLAN\n")
+	fmt.Printf("       netbox2dns [--config=FILE] [--timeout=DURATION] serve\n")
 	os.Exit(1)
 }
 
+// loadConfig finds and parses the config file.
+func loadConfig() (*nb.Config, error) {
+	file := *config
+	if file == "" {
+		var err error
+		file, err = nb.FindConfig("netbox2dns")
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg, err := nb.ParseConfig(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse config: %v", err)
+	}
+	log.Infof("Config read: %+v", cfg)
+	return cfg, nil
+}
+
+// Exit codes.  These let cron jobs and CI tell a partial failure,
+// where some zones were updated, from a total failure.
+const (
+	exitOK      = 0
+	exitFailed  = 1 // Nothing was done; also used for usage and config errors
+	exitPartial = 2 // Some zones or records failed
+)
+
+// exit writes the report, if needed, and exits with a code that
+// matches its status.
+func exit(info io.Writer, report *nb.Report, always bool) {
+	if always || report.Status != nb.StatusOK {
+		fmt.Fprintf(info, "Zone summary:\n")
+		err := report.Write(info, *output)
+		if err != nil {
+			log.Errorf("Unable to write summary: %v", err)
+		}
+	}
+	log.Flush()
+	switch report.Status {
+	case nb.StatusOK:
+		os.Exit(exitOK)
+	case nb.StatusPartial:
+		os.Exit(exitPartial)
+	default:
+		os.Exit(exitFailed)
+	}
+}
+
 func main() {
 	flag.Parse()
 	args := flag.Args()
-	push := false
 
-	if len(args) != 1 {
+	if len(args) < 1 {
 		usage()
 	}
+	mode := args[0]
 
-	switch args[0] {
-	case "push":
-		push = true
-	case "diff":
-		// nothing
+	switch mode {
+	case "diff", "push", "serve":
+		if len(args) != 1 {
+			usage()
+		}
+	case "plan":
+		if len(args) != 1 || *out == "" {
+			usage()
+		}
+	case "apply":
+		if len(args) != 2 {
+			usage()
+		}
 	default:
 		usage()
 	}
 
-	var err error
-
-	// Load config file
-	file := *config
-	if file == "" {
-		file, err = nb.FindConfig("netbox2dns")
-		if err != nil {
-			log.Fatal(err)
-		}
+	// Keep stdout clean for JSON and YAML output.
+	info := os.Stdout
+	switch *output {
+	case "text":
+	case "json", "yaml":
+		info = os.Stderr
+	default:
+		usage()
 	}
-	cfg, err := nb.ParseConfig(file)
+
+	cfg, err := loadConfig()
 	if err != nil {
-		log.Fatalf("Failed to parse config: %v", err)
+		log.Exit(err)
 	}
-	log.Infof("Config read: %+v", cfg)
 
-	ctx := context.Background()
+	if mode == "serve" {
+		serve(context.Background(), cfg)
+		return
+	}
 
-	// Fetch existing DNS zones and entries
-	zones, err := nb.ImportZones(ctx, cfg)
+	// Providers may hold on to the context that they're created
+	// with, so they get one that's never canceled.
+	syncer, err := nb.NewSyncer(context.Background(), cfg)
 	if err != nil {
-		log.Fatalf("Unable to import existing zones: %v", err)
+		log.Exit(err)
 	}
+	syncer.Force = *force
 
-	log.Infof("Found %d zones", len(zones.Zones))
+	// SIGINT and SIGTERM stop the run cleanly: no new changes are
+	// started, and zones that weren't finished are reported as
+	// failed.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 
-	// Create new zones using data from Netbox
-	newZones := nb.NewZones()
-	for _, cz := range cfg.ZoneMap {
-		newZones.NewZone(cz)
+	// Apply a saved plan, without looking at Netbox.
+	if mode == "apply" {
+		plan, err := nb.LoadPlan(args[1])
+		if err != nil {
+			log.Exit(err)
+		}
+		report, err := syncer.ApplyPlan(ctx, plan)
+		if report == nil {
+			log.Exit(err)
+		}
+		err = plan.Diff.Write(os.Stdout, *output)
+		if err != nil {
+			log.Exitf("Unable to write changes: %v", err)
+		}
+		fmt.Fprintf(info, "Apply complete.  %d removals, %d additions\n", plan.Diff.Removals, plan.Diff.Additions)
+		exit(info, report, true)
 	}
 
-	addrs, err := nb.GetNetboxIPAddresses(cfg.Netbox.Host, cfg.Netbox.Token)
+	result, err := syncer.Plan(ctx)
 	if err != nil {
-		log.Fatalf("Unable to fetch IP Addresses from Netbox: %v", err)
+		log.Exit(err)
 	}
+	diff := result.Diff
 
-	fmt.Printf("Found %d IP Addresses in %d zones\n", len(addrs), len(newZones.Zones))
+	fmt.Fprintf(info, "Found %d IP Addresses in %d zones\n", result.Addresses, len(cfg.ZoneMap))
+	for _, w := range result.Warnings {
+		fmt.Fprintf(info, "WARNING: %v\n", w)
+	}
 
-	// Add Netbox IPs to our new zones
-	err = newZones.AddAddrs(addrs)
+	err = diff.Write(os.Stdout, *output)
 	if err != nil {
-		log.Fatalf("Unable to add IP addresses: %v", err)
+		log.Exitf("Unable to write changes: %v", err)
 	}
 
-	log.Infof("Created %d zones", len(newZones.Zones))
+	switch mode {
+	case "plan":
+		if len(result.Warnings) > 0 && !*force {
+			log.Exitf("Refusing to save a plan that exceeds safety limits; use --force to override")
+		}
+		plan := nb.NewPlan(diff, result.Imported)
+		err = plan.Save(*out)
+		if err != nil {
+			log.Exit(err)
+		}
+		fmt.Fprintf(info, "Plan written to %s.  %d removals, %d additions found\n", *out, diff.Removals, diff.Additions)
+		exit(info, result.Report, false)
+	case "push":
+		if len(result.Warnings) > 0 && !*force {
+			log.Exitf("Refusing to push changes that exceed safety limits; use --force to override")
+		}
+		err = syncer.Push(ctx, result)
+		if err != nil {
+			if result.Report.Status == nb.StatusOK {
+				// Not a zone failure, like a failed state file write.
+				log.Exit(err)
+			}
+			log.Error(err)
+		}
+		fmt.Fprintf(info, "Push complete.  %d removals, %d additions found\n", diff.Removals, diff.Additions)
+		exit(info, result.Report, true)
+	default:
+		fmt.Fprintf(info, "Diff complete.  %d removals, %d additions found\n", diff.Removals, diff.Additions)
+		exit(info, result.Report, false)
+	}
+}
 
-	// Compare imported zones to created zones and produce a diff.
-	zd := zones.Compare(newZones)
+// withTimeout returns a copy of ctx that's canceled after --timeout,
+// if it's set.
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if *timeout > 0 {
+		return context.WithTimeout(ctx, *timeout)
+	}
+	return context.WithCancel(ctx)
+}
 
-	removeCount := 0
-	addCount := 0
+// reloadSyncer reads the config file again and returns a Syncer for
+// it.  The new config is fully checked before anything uses it, and
+// nothing is shared with the old Syncer, so the old one keeps working
+// unchanged if this fails.
+func reloadSyncer(ctx context.Context) (*nb.Syncer, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := cfg.Serve.Durations(); err != nil {
+		return nil, err
+	}
+	return nb.NewSyncer(ctx, cfg)
+}
 
-	for _, zone := range zd {
-		changed := false
+// serve syncs DNS with Netbox every `serve.interval`, plus a random
+// jitter, until it receives SIGTERM or SIGINT.  A run that's in
+// progress is allowed to finish before exiting.  SIGHUP reloads the
+// config file and starts a new run immediately; if the new config is
+// invalid, then the old one is kept.
+//
+// If `serve.listen` is set, then Prometheus metrics are served on
+// /metrics.  If `serve.webhook_secret` is also set, then Netbox
+// webhooks are accepted on /webhook, and the records for the IP
+// addresses that they mention are updated between full runs.  The
+// listen address and secret aren't changed by SIGHUP.
+//
+// Each run, including runs for webhooks, is limited by --timeout.
+//
+// --force is ignored here, so that a one-off override doesn't disable
+// the safety limits forever.  If a run is refused, then run `push
+// --force` by hand.
+func serve(ctx context.Context, cfg *nb.Config) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
 
-		provider, err := nb.NewDNSProvider(ctx, cfg.ZoneMap[zone.Name])
-		if err != nil {
-			log.Fatalf("Failed to create DNS provider for %q: %v", zone.Name, err)
-		}
+	syncer, err := nb.NewSyncer(ctx, cfg)
+	if err != nil {
+		log.Exit(err)
+	}
+	if _, _, err := cfg.Serve.Durations(); err != nil {
+		log.Exit(err)
+	}
 
-		for _, rec := range zone.RemoveRecords {
-			for _, rr := range rec {
-				if rr.Type == "A" || rr.Type == "AAAA" || rr.Type == "PTR" {
-					removeCount++
-					fmt.Printf("- %s %s %d %v\n", rr.Name, rr.Type, rr.TTL, rr.Rrdatas)
-					if push {
-						err := provider.RemoveRecord(cfg.ZoneMap[zone.Name], rr)
-						changed = true
-						if err != nil {
-							log.Errorf("Failed to remove record: %v", err)
-						}
-					}
-				}
-			}
+	// Webhooks are only queued by the HTTP server; all syncing
+	// happens in this goroutine.
+	var webhooks <-chan struct{}
+	var hooks *nb.WebhookHandler
+	if cfg.Serve.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", nb.MetricsHandler())
+		if cfg.Serve.WebhookSecret != "" {
+			hooks = nb.NewWebhookHandler(cfg.Serve.WebhookSecret)
+			webhooks = hooks.Ready()
+			mux.Handle("/webhook", hooks)
+		} else {
+			log.Warningf("serve.webhook_secret isn't set; webhooks are disabled")
 		}
-		for _, rec := range zone.AddRecords {
-			for _, rr := range rec {
-				addCount++
-				fmt.Printf("+ %s %s %d %v\n", rr.Name, rr.Type, rr.TTL, rr.Rrdatas)
-				if push {
-					err = provider.WriteRecord(cfg.ZoneMap[zone.Name], rr)
-					changed = true
-					if err != nil {
-						log.Errorf("Failed to update record: %v", err)
-					}
-				}
+		go func() {
+			log.Infof("Listening on %s", cfg.Serve.Listen)
+			log.Exit(http.ListenAndServe(cfg.Serve.Listen, mux))
+		}()
+	}
+
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-timer.C:
+			start := time.Now()
+			runCtx, cancel := withTimeout(ctx)
+			result, err := syncer.Sync(runCtx)
+			cancel()
+			if err != nil {
+				log.Errorf("Sync failed after %v: %v", time.Since(start), err)
+			} else {
+				log.Infof("Sync complete in %v.  %d removals, %d additions", time.Since(start), result.Diff.Removals, result.Diff.Additions)
 			}
-		}
 
-		if changed {
-			err := provider.Save(cfg.ZoneMap[zone.Name])
+			interval, jitter, _ := syncer.Config.Serve.Durations()
+			wait := interval
+			if jitter > 0 {
+				wait += time.Duration(rand.Int63n(int64(jitter)))
+			}
+			log.Infof("Next sync in %v", wait)
+			timer.Reset(wait)
+		case <-webhooks:
+			cs := hooks.Take()
+			if cs.Empty() {
+				continue
+			}
+			start := time.Now()
+			runCtx, cancel := withTimeout(ctx)
+			result, err := syncer.SyncChanges(runCtx, cs)
+			cancel()
 			if err != nil {
-				log.Fatalf("Failed to save: %v", err)
+				log.Errorf("Webhook sync failed after %v: %v", time.Since(start), err)
+			} else {
+				log.Infof("Webhook sync complete in %v.  %d removals, %d additions", time.Since(start), result.Diff.Removals, result.Diff.Additions)
 			}
-		}
-	}
+		case sig := <-sigs:
+			if sig != syscall.SIGHUP {
+				log.Infof("Received %v, exiting", sig)
+				log.Flush()
+				return
+			}
+			log.Infof("Received SIGHUP, reloading config")
+			newSyncer, err := reloadSyncer(ctx)
+			if err != nil {
+				log.Errorf("Unable to reload config, keeping the old one: %v", err)
+				continue
+			}
+			syncer = newSyncer
 
-	if push {
-		fmt.Printf("Push complete.  %d removals, %d additions found\n", removeCount, addCount)
-	} else {
-		fmt.Printf("Diff complete.  %d removals, %d additions found\n", removeCount, addCount)
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(0)
+		}
 	}
 }
@@ -6,25 +6,106 @@
 // Each field has a type ("string"), optionally a default (*),
 // and some constraints.
 #CloudDNSZone: {
-	zonetype:        "clouddns"
-	name:            string
-	zonename:        string
-	project:         *config.defaults.project | string
-	ttl:             *config.defaults.ttl | int & >60 & <=86400
-	delete_entries?: *false | bool // Remove entries that are missing
+	zonetype:                "clouddns"
+	name:                    string
+	zonename:                string
+	project:                 *config.defaults.project | string
+	ttl:                     *config.defaults.ttl | int & >60 & <=86400
+	delete_entries?:         *false | bool // Remove entries that are missing
+	ignore_ttl:              *config.defaults.ignore_ttl | bool // See `defaults`
+	max_deletions:           *config.safety.max_deletions | int & >=0
+	max_deletion_percent:    *config.safety.max_deletion_percent | number & >=0 & <=100
+	name_template?:          string        // See `defaults`
+	name_template_override?: *false | bool
+	filters?:                #Filter // Only add matching addresses to this zone
+	view:                    *"" | string
+	vrfs?:                   [...string] // Only add addresses in these VRFs ("" is global)
 	...
 }
 
 #ZoneFileZone: {
-	zonetype:        "zonefile"
-	name:            string
-	filename:        string
-	ttl:             *config.defaults.ttl | int & >60 & <=86400
-	delete_entries?: *false | bool // Remove entries that are missing
+	zonetype:                "zonefile"
+	name:                    string
+	filename:                string
+	ttl:                     *config.defaults.ttl | int & >60 & <=86400
+	delete_entries?:         *false | bool // Remove entries that are missing
+	ignore_ttl:              *config.defaults.ignore_ttl | bool // See `defaults`
+	max_deletions:           *config.safety.max_deletions | int & >=0
+	max_deletion_percent:    *config.safety.max_deletion_percent | number & >=0 & <=100
+	name_template?:          string        // See `defaults`
+	name_template_override?: *false | bool
+	managed_block?:          *false | bool // Only edit between "; BEGIN netbox2dns" and "; END netbox2dns"
+	filters?:                #Filter // Only add matching addresses to this zone
+	view:                    *"" | string
+	vrfs?:                   [...string] // Only add addresses in these VRFs ("" is global)
 	...
 }
 
-#Zone: #CloudDNSZone | #ZoneFileZone
+// A #RFC2136Zone is a DNS zone hosted on a server that supports
+// AXFR and RFC 2136 dynamic updates, like BIND or Knot.  Updates are
+// signed with TSIG when tsig_name is set.
+#RFC2136Zone: {
+	zonetype:                "rfc2136"
+	name:                    string
+	server:                  string // host or host:port
+	tsig_name?:              string
+	tsig_algorithm:          *"hmac-sha256" | "hmac-sha1" | "hmac-sha224" | "hmac-sha384" | "hmac-sha512"
+	tsig_secret?:            string // base64
+	ttl:                     *config.defaults.ttl | int & >60 & <=86400
+	delete_entries?:         *false | bool // Remove entries that are missing
+	ignore_ttl:              *config.defaults.ignore_ttl | bool // See `defaults`
+	max_deletions:           *config.safety.max_deletions | int & >=0
+	max_deletion_percent:    *config.safety.max_deletion_percent | number & >=0 & <=100
+	name_template?:          string        // See `defaults`
+	name_template_override?: *false | bool
+	filters?:                #Filter // Only add matching addresses to this zone
+	view:                    *"" | string
+	vrfs?:                   [...string] // Only add addresses in these VRFs ("" is global)
+	...
+}
+
+// A #PowerDNSZone is a DNS zone hosted on a PowerDNS Authoritative
+// Server, managed through its HTTP API.
+#PowerDNSZone: {
+	zonetype:                "powerdns"
+	name:                    string
+	api_url:                 string // for example, "http://pdns.example.com:8081"
+	api_key:                 string
+	server_id:               *"localhost" | string
+	ttl:                     *config.defaults.ttl | int & >60 & <=86400
+	delete_entries?:         *false | bool // Remove entries that are missing
+	ignore_ttl:              *config.defaults.ignore_ttl | bool // See `defaults`
+	max_deletions:           *config.safety.max_deletions | int & >=0
+	max_deletion_percent:    *config.safety.max_deletion_percent | number & >=0 & <=100
+	name_template?:          string        // See `defaults`
+	name_template_override?: *false | bool
+	filters?:                #Filter // Only add matching addresses to this zone
+	view:                    *"" | string
+	vrfs?:                   [...string] // Only add addresses in these VRFs ("" is global)
+	...
+}
+
+// A #Filter selects which Netbox IP addresses are added to DNS.
+// Every list is optional.  An address must match at least one entry
+// in each include list that's set, and must not match any entry in
+// any exclude list.  Tags, tenants, and roles use Netbox slugs or
+// values, and VRFs use the VRF name; "" matches addresses without a
+// tenant, VRF, or role.
+#Filter: {
+	status?:           [...string] // "active", "dhcp", "reserved", ...
+	tags?:             [...string]
+	exclude_tags?:     [...string]
+	tenants?:          [...string]
+	exclude_tenants?:  [...string]
+	vrfs?:             [...string]
+	exclude_vrfs?:     [...string]
+	roles?:            [...string] // "loopback", "anycast", "vip", ...
+	exclude_roles?:    [...string]
+	prefixes?:         [...string] // "10.0.0.0/8", ...
+	exclude_prefixes?: [...string]
+}
+
+#Zone: #CloudDNSZone | #ZoneFileZone | #RFC2136Zone | #PowerDNSZone
 
 // This is the template for the actual configuration.
 config: {
@@ -37,9 +118,17 @@ config: {
 	// is less convienent in the config file but more convienent
 	// to use.
 	zonemap: [string]: #Zone
+	//
+	// Zones in a view are keyed as "<view>/<name>", so the same
+	// zone name can be used in several views for split-horizon DNS.
 	zonemap: {
 		for z in zones {
-			"\(z.name)": z
+			if z.view == "" {
+				"\(z.name)": z
+			}
+			if z.view != "" {
+				"\(z.view)/\(z.name)": z
+			}
 		}
 	}
 
@@ -49,9 +138,122 @@ config: {
 		token: string
 	}
 
+	// How to choose DNS names for IP addresses.  "dns_name" only
+	// uses the IP address's `dns_name` field in Netbox.
+	// "fallback" generates a name from the IP address's device or
+	// VM interface when `dns_name` is empty, and "all" generates
+	// names for every assigned IP address, in addition to
+	// `dns_name`.  Device interfaces are named
+	// <interface>.<device>.<site>.<device_domain>, and VM
+	// interfaces are named <vm>.<cluster>.<vm_domain>.
+	//
+	// primary_names adds a short name for each device and VM
+	// with a primary IP, like <device>.<primary_domain>.  "cname"
+	// makes this a CNAME to the primary IP's name, and "address"
+	// makes it an A/AAAA record without a PTR.
+	naming: {
+		mode:            *"dns_name" | "fallback" | "all"
+		device_domain?:  string
+		vm_domain?:      string
+		primary_names:   *"none" | "address" | "cname"
+		primary_domain?: string
+	}
+
+	// Filters that apply to all IP addresses.  These are also sent
+	// to Netbox, where possible, to avoid downloading addresses
+	// that won't be used.  Filters on a zone further restrict which
+	// addresses get records in that zone.
+	filters: #Filter & {
+		status: *["active", "dhcp"] | [...string]
+	}
+
+	// Limits on how many records `push` may remove from a single
+	// zone, as a count and as a percentage of the zone's current A,
+	// AAAA, and PTR records.  If a zone goes over either limit,
+	// then nothing is pushed unless --force is used.  0 means no
+	// limit.  Zones can override these.
+	//
+	// If state_file is set, then the number of IP addresses fetched
+	// from Netbox is saved there after each run, and the next run
+	// fails if the count drops by more than max_address_drop_percent.
+	safety: {
+		max_deletions:            *0 | int & >=0
+		max_deletion_percent:     *0 | number & >=0 & <=100
+		state_file?:              string
+		max_address_drop_percent: *0 | number & >=0 & <=100
+	}
+
+	// Ownership registry.  With mode "txt", netbox2dns creates a
+	// TXT record named <txt_prefix><name> next to every name that
+	// it creates, and only removes records from names that have
+	// a TXT record with its owner_id.  Use a different owner_id
+	// for each netbox2dns instance that shares a zone.
+	registry: {
+		mode:       *"none" | "txt"
+		owner_id:   *"default" | string
+		txt_prefix: *"_netbox2dns." | string
+	}
+
+	// The number of zones that are imported or pushed at the same
+	// time.
+	concurrency: *4 | int & >=1
+
+	// Calls to DNS provider APIs that fail with a temporary error,
+	// like a timeout, an HTTP 429 or 5xx, or a Cloud DNS rate limit
+	// error, are tried up to `attempts` times.  The delay before
+	// each retry starts at `delay` and doubles each time, up to
+	// `max_delay`, with some random jitter.
+	retry: {
+		attempts:  *5 | int & >=1
+		delay:     *"1s" | string
+		max_delay: *"30s" | string
+	}
+
+	// The most API calls per second to send to each zonetype,
+	// shared by all zones of that type.  0 means no limit.
+	rate_limits: {
+		clouddns: *5 | number & >=0
+		rfc2136:  *0 | number & >=0
+		powerdns: *0 | number & >=0
+	}
+
+	// Settings for `netbox2dns serve`, which syncs every
+	// `interval`, plus a random delay of up to `jitter`.  Both are Go
+	// durations, like "5m" or "30s".
+	//
+	// If `listen` is set, then an HTTP server is started on that
+	// address, like ":8080", with Prometheus metrics on `/metrics`.
+	// If `webhook_secret` is also set, then
+	// Netbox webhooks for IP addresses can be sent to `/webhook`,
+	// signed with that secret, and their records are updated right
+	// away.
+	serve: {
+		interval:        *"5m" | string
+		jitter:          *"30s" | string
+		listen:          *"" | string
+		webhook_secret?: string
+	}
+
 	// Defaults.  Notice the `*config.defaults.` clauses above, in #CloudDNSZone.
 	defaults: {
 		ttl:       *300 | int
 		project?:  *"foo" | string
+
+		// A Go text/template that generates DNS names for IP
+		// addresses, used when `dns_name` is empty, or always
+		// if `name_template_override` is true.  A template on
+		// a zone applies to IP addresses whose reverse DNS
+		// name is in that zone; this one applies to all other
+		// IP addresses.  See `NameTemplateData` in names.go
+		// for the available fields.  For example:
+		//
+		//   "{{label .Interface}}.{{label .Device}}.{{.Site}}.example.com"
+		name_template?:          string
+		name_template_override?: *false | bool
+
+		// Treat records that only differ by TTL as unchanged,
+		// instead of replacing them to fix the TTL.  Useful when
+		// TTLs are managed by hand, or by another tool.
+		ignore_ttl: *false | bool
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"cuelang.org/go/cue"
 	"cuelang.org/go/cue/cuecontext"
@@ -30,27 +31,182 @@ type Config struct {
 		Token string `json:"token,omitempty"`
 	} `json:"netbox,omitempty"`
 	Defaults struct {
-		Zonetype string `json:"zonetype,omitempty"`
-		TTL      int64  `json:"ttl,omitempty"`
-		Project  string `json:"project,omitempty"`
+		Zonetype             string `json:"zonetype,omitempty"`
+		TTL                  int64  `json:"ttl,omitempty"`
+		Project              string `json:"project,omitempty"`
+		NameTemplate         string `json:"name_template,omitempty"`
+		NameTemplateOverride bool   `json:"name_template_override,omitempty"`
+		IgnoreTTL            bool   `json:"ignore_ttl,omitempty"`
 	} `json:"defaults,omitempty"`
-	ZoneMap map[string]*ConfigZone `json:"zonemap,omitempty"`
-	Zones   []*ConfigZone          `json:"zones,omitempty"`
+	Naming      ConfigNaming           `json:"naming,omitempty"`
+	Filters     ConfigFilter           `json:"filters,omitempty"`
+	Registry    ConfigRegistry         `json:"registry,omitempty"`
+	Safety      ConfigSafety           `json:"safety,omitempty"`
+	Serve       ConfigServe            `json:"serve,omitempty"`
+	Concurrency int                    `json:"concurrency,omitempty"`
+	Retry       ConfigRetry            `json:"retry,omitempty"`
+	RateLimits  map[string]float64     `json:"rate_limits,omitempty"`
+	ZoneMap     map[string]*ConfigZone `json:"zonemap,omitempty"`
+	Zones       []*ConfigZone          `json:"zones,omitempty"`
 }
 
 // ConfigZone matches `Zone` in `config.cue`.  This needs to be
-// the union of all defined zone types.  At the moment, this is only
-// CloudDNSZone, but other types are possible.  They're switched based
-// on the `ZoneType` field.  Then, code in `dns.go` uses that to
-// dispatch to the correct back-end handler.
+// the union of all defined zone types (CloudDNSZone, ZoneFileZone,
+// RFC2136Zone, PowerDNSZone).  They're switched based on the
+// `ZoneType` field.  Then, code in `dns.go` uses that to dispatch to
+// the correct back-end handler.
 type ConfigZone struct {
-	ZoneType      string `json:"zonetype,omitempty"`
-	Name          string `json:"name,omitempty"`
-	ZoneName      string `json:"zonename,omitempty"`
-	Filename      string `json:"filename,omitempty"`
-	Project       string `json:"project,omitempty"`
-	TTL           int64  `json:"ttl,omitempty"`
-	DeleteEntries bool   `json:"delete_entries,omitempty"`
+	ZoneType             string  `json:"zonetype,omitempty"`
+	Name                 string  `json:"name,omitempty"`
+	ZoneName             string  `json:"zonename,omitempty"`
+	Filename             string  `json:"filename,omitempty"`
+	Project              string  `json:"project,omitempty"`
+	TTL                  int64   `json:"ttl,omitempty"`
+	DeleteEntries        bool    `json:"delete_entries,omitempty"`
+	IgnoreTTL            bool    `json:"ignore_ttl,omitempty"`
+	MaxDeletions         int64   `json:"max_deletions,omitempty"`
+	MaxDeletionPercent   float64 `json:"max_deletion_percent,omitempty"`
+	ManagedBlock         bool    `json:"managed_block,omitempty"`
+	NameTemplate         string  `json:"name_template,omitempty"`
+	NameTemplateOverride bool    `json:"name_template_override,omitempty"`
+	Server               string  `json:"server,omitempty"`
+	TSIGName             string  `json:"tsig_name,omitempty"`
+	TSIGAlgorithm        string  `json:"tsig_algorithm,omitempty"`
+	TSIGSecret           string  `json:"tsig_secret,omitempty"`
+	APIURL               string  `json:"api_url,omitempty"`
+	APIKey               string  `json:"api_key,omitempty"`
+	ServerID             string  `json:"server_id,omitempty"`
+
+	Filters *ConfigFilter `json:"filters,omitempty"`
+	View    string        `json:"view,omitempty"`
+	VRFs    []string      `json:"vrfs,omitempty"`
+}
+
+// Key returns the key for this zone in ZoneMap.  This is the zone's
+// name, prefixed with "<view>/" if the zone is in a view.
+func (cz *ConfigZone) Key() string {
+	return zoneKey(cz.View, cz.Name)
+}
+
+// ConfigNaming matches the `naming` item in `config.cue`.  It
+// controls how DNS names are chosen for Netbox IP addresses.
+type ConfigNaming struct {
+	Mode          string `json:"mode,omitempty"`
+	DeviceDomain  string `json:"device_domain,omitempty"`
+	VMDomain      string `json:"vm_domain,omitempty"`
+	PrimaryNames  string `json:"primary_names,omitempty"`
+	PrimaryDomain string `json:"primary_domain,omitempty"`
+}
+
+// ConfigFilter matches `#Filter` in `config.cue`.  It's used for both
+// the global `filters` setting and per-zone filters.
+type ConfigFilter struct {
+	Status          []string `json:"status,omitempty"`
+	Tags            []string `json:"tags,omitempty"`
+	ExcludeTags     []string `json:"exclude_tags,omitempty"`
+	Tenants         []string `json:"tenants,omitempty"`
+	ExcludeTenants  []string `json:"exclude_tenants,omitempty"`
+	VRFs            []string `json:"vrfs,omitempty"`
+	ExcludeVRFs     []string `json:"exclude_vrfs,omitempty"`
+	Roles           []string `json:"roles,omitempty"`
+	ExcludeRoles    []string `json:"exclude_roles,omitempty"`
+	Prefixes        []string `json:"prefixes,omitempty"`
+	ExcludePrefixes []string `json:"exclude_prefixes,omitempty"`
+}
+
+// ConfigSafety matches the `safety` item in `config.cue`.
+type ConfigSafety struct {
+	MaxDeletions          int64   `json:"max_deletions,omitempty"`
+	MaxDeletionPercent    float64 `json:"max_deletion_percent,omitempty"`
+	StateFile             string  `json:"state_file,omitempty"`
+	MaxAddressDropPercent float64 `json:"max_address_drop_percent,omitempty"`
+}
+
+// workers returns the number of zones to work on at once.
+func (c *Config) workers() int {
+	return max(c.Concurrency, 1)
+}
+
+// ConfigRetry matches the `retry` item in `config.cue`.
+type ConfigRetry struct {
+	Attempts int    `json:"attempts,omitempty"`
+	Delay    string `json:"delay,omitempty"`
+	MaxDelay string `json:"max_delay,omitempty"`
+}
+
+// Durations parses the delay settings.  An empty ConfigRetry, as in a
+// Config that wasn't loaded through `config.cue`, has no delays.
+func (c ConfigRetry) Durations() (delay, maxDelay time.Duration, err error) {
+	if c == (ConfigRetry{}) {
+		return 0, 0, nil
+	}
+	delay, err = time.ParseDuration(c.Delay)
+	if err != nil || delay < 0 {
+		return 0, 0, fmt.Errorf("Invalid retry delay %q", c.Delay)
+	}
+	maxDelay, err = time.ParseDuration(c.MaxDelay)
+	if err != nil || maxDelay < delay {
+		return 0, 0, fmt.Errorf("Invalid retry max_delay %q", c.MaxDelay)
+	}
+	return delay, maxDelay, nil
+}
+
+// ConfigServe matches the `serve` item in `config.cue`.
+type ConfigServe struct {
+	Interval      string `json:"interval,omitempty"`
+	Jitter        string `json:"jitter,omitempty"`
+	Listen        string `json:"listen,omitempty"`
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+}
+
+// Durations parses the interval and jitter settings.
+func (c ConfigServe) Durations() (interval, jitter time.Duration, err error) {
+	interval, err = time.ParseDuration(c.Interval)
+	if err != nil || interval <= 0 {
+		return 0, 0, fmt.Errorf("Invalid serve interval %q", c.Interval)
+	}
+	jitter, err = time.ParseDuration(c.Jitter)
+	if err != nil || jitter < 0 {
+		return 0, 0, fmt.Errorf("Invalid serve jitter %q", c.Jitter)
+	}
+	return interval, jitter, nil
+}
+
+// ConfigRegistry matches the `registry` item in `config.cue`.
+type ConfigRegistry struct {
+	Mode      string `json:"mode,omitempty"`
+	OwnerID   string `json:"owner_id,omitempty"`
+	TXTPrefix string `json:"txt_prefix,omitempty"`
+}
+
+// NeedsHosts returns true if the config generates names from Netbox
+// devices and VMs, which means that GetNetboxHosts needs to be called.
+func (c *Config) NeedsHosts() bool {
+	if c.Naming.Mode == "fallback" || c.Naming.Mode == "all" || c.Defaults.NameTemplate != "" {
+		return true
+	}
+	if c.Naming.PrimaryNames == "address" || c.Naming.PrimaryNames == "cname" {
+		return true
+	}
+	for _, cz := range c.ZoneMap {
+		if cz.NameTemplate != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Managed returns the records that netbox2dns manages with this
+// config: the DefaultManaged types, plus CNAME if
+// `naming.primary_names` is "cname", plus this owner's TXT records if
+// `registry.mode` is "txt".
+func (c *Config) Managed() *Managed {
+	m := DefaultManaged()
+	m.Registry = NewRegistry(c.Registry)
+	if c.Naming.PrimaryNames == "cname" {
+		m.Types["CNAME"] = true
+	}
+	return m
 }
 
 // This causes "config.cue" in the current directory to be embedded
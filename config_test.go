@@ -1,7 +1,9 @@
 package netbox2dns
 
 import (
+	"fmt"
 	"testing"
+	"time"
 )
 
 func TestFindConfig(t *testing.T) {
@@ -105,6 +107,35 @@ func valueTest(t *testing.T, cfg *Config, err error) {
 	if z.DeleteEntries != true {
 		t.Errorf("z.DeleteEntries wrong; want true")
 	}
+	if cfg.Naming.Mode != "dns_name" {
+		t.Errorf("cfg.Naming.Mode wrong; got %q want %q", cfg.Naming.Mode, "dns_name")
+	}
+	if cfg.Naming.PrimaryNames != "none" {
+		t.Errorf("cfg.Naming.PrimaryNames wrong; got %q want %q", cfg.Naming.PrimaryNames, "none")
+	}
+	if fmt.Sprint(cfg.Filters.Status) != "[active dhcp]" {
+		t.Errorf("cfg.Filters.Status wrong; got %v want [active dhcp]", cfg.Filters.Status)
+	}
+	interval, jitter, err := cfg.Serve.Durations()
+	if err != nil || interval != 5*time.Minute || jitter != 30*time.Second {
+		t.Errorf("cfg.Serve.Durations() wrong; got %v, %v, %v want 5m, 30s", interval, jitter, err)
+	}
+	if cfg.Defaults.IgnoreTTL || cfg.ZoneMap["example.com"].IgnoreTTL {
+		t.Errorf("ignore_ttl wrong; got %v, %v want false", cfg.Defaults.IgnoreTTL, cfg.ZoneMap["example.com"].IgnoreTTL)
+	}
+	if cfg.Concurrency != 4 {
+		t.Errorf("cfg.Concurrency wrong; got %d want 4", cfg.Concurrency)
+	}
+	delay, maxDelay, err := cfg.Retry.Durations()
+	if err != nil || cfg.Retry.Attempts != 5 || delay != time.Second || maxDelay != 30*time.Second {
+		t.Errorf("cfg.Retry wrong; got %+v, %v, %v, %v", cfg.Retry, delay, maxDelay, err)
+	}
+	if cfg.RateLimits["clouddns"] != 5 || cfg.RateLimits["rfc2136"] != 0 {
+		t.Errorf("cfg.RateLimits wrong; got %v", cfg.RateLimits)
+	}
+	if cfg.Registry.Mode != "none" || cfg.Registry.OwnerID != "default" || cfg.Registry.TXTPrefix != "_netbox2dns." {
+		t.Errorf("cfg.Registry wrong; got %+v", cfg.Registry)
+	}
 }
 
 func TestValidateYaml(t *testing.T) {
@@ -113,3 +144,128 @@ func TestValidateYaml(t *testing.T) {
 		t.Errorf("Should have failed validation, but succeeded.")
 	}
 }
+
+func TestParseRFC2136(t *testing.T) {
+	cfg, err := ParseConfig("testdata/config6/conf.yaml")
+	if err != nil {
+		t.Fatalf("Unable to parse config: %v", err)
+	}
+
+	z := cfg.ZoneMap["internal.example.com"]
+	if z == nil {
+		t.Fatalf("Failed to find zone for internal.example.com")
+	}
+	if z.ZoneType != "rfc2136" {
+		t.Errorf("z.ZoneType wrong; got %q want %q", z.ZoneType, "rfc2136")
+	}
+	if z.Server != "ns1.example.com" {
+		t.Errorf("z.Server wrong; got %q want %q", z.Server, "ns1.example.com")
+	}
+	if z.TSIGName != "netbox2dns" {
+		t.Errorf("z.TSIGName wrong; got %q want %q", z.TSIGName, "netbox2dns")
+	}
+	if z.TSIGAlgorithm != "hmac-sha256" {
+		t.Errorf("z.TSIGAlgorithm wrong; got %q want %q", z.TSIGAlgorithm, "hmac-sha256")
+	}
+	if z.TTL != 300 {
+		t.Errorf("z.TTL wrong; got %d want 300", z.TTL)
+	}
+	if cfg.Defaults.NameTemplate != "{{label .Interface}}.{{label .Device}}.example.com" {
+		t.Errorf("cfg.Defaults.NameTemplate wrong; got %q", cfg.Defaults.NameTemplate)
+	}
+	if !cfg.NeedsHosts() {
+		t.Errorf("cfg.NeedsHosts() wrong; got false want true")
+	}
+}
+
+func TestParsePowerDNS(t *testing.T) {
+	cfg, err := ParseConfig("testdata/config6/conf.yaml")
+	if err != nil {
+		t.Fatalf("Unable to parse config: %v", err)
+	}
+
+	z := cfg.ZoneMap["example.net"]
+	if z == nil {
+		t.Fatalf("Failed to find zone for example.net")
+	}
+	if z.ZoneType != "powerdns" {
+		t.Errorf("z.ZoneType wrong; got %q want %q", z.ZoneType, "powerdns")
+	}
+	if z.APIURL != "http://pdns.example.com:8081" {
+		t.Errorf("z.APIURL wrong; got %q want %q", z.APIURL, "http://pdns.example.com:8081")
+	}
+	if z.APIKey != "changeme" {
+		t.Errorf("z.APIKey wrong; got %q want %q", z.APIKey, "changeme")
+	}
+	if z.ServerID != "localhost" {
+		t.Errorf("z.ServerID wrong; got %q want %q", z.ServerID, "localhost")
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	cfg, err := ParseConfig("testdata/config6/conf.yaml")
+	if err != nil {
+		t.Fatalf("Unable to parse config: %v", err)
+	}
+
+	if fmt.Sprint(cfg.Filters.ExcludeVRFs) != "[lab]" {
+		t.Errorf("cfg.Filters.ExcludeVRFs wrong; got %v want [lab]", cfg.Filters.ExcludeVRFs)
+	}
+	if fmt.Sprint(cfg.Filters.Status) != "[active dhcp]" {
+		t.Errorf("cfg.Filters.Status wrong; got %v want [active dhcp]", cfg.Filters.Status)
+	}
+
+	z := cfg.ZoneMap["internal.example.com"]
+	if z.Filters == nil || fmt.Sprint(z.Filters.Tags) != "[internal]" {
+		t.Errorf("z.Filters wrong; got %+v want tags [internal]", z.Filters)
+	}
+	if cfg.ZoneMap["example.net"].Filters != nil {
+		t.Errorf("example.net Filters wrong; got %+v want nil", cfg.ZoneMap["example.net"].Filters)
+	}
+}
+
+func TestParseViews(t *testing.T) {
+	cfg, err := ParseConfig("testdata/config7/conf.yaml")
+	if err != nil {
+		t.Fatalf("Unable to parse config: %v", err)
+	}
+
+	if len(cfg.ZoneMap) != 2 {
+		t.Fatalf("len(cfg.ZoneMap) wrong; got %d want 2", len(cfg.ZoneMap))
+	}
+
+	z := cfg.ZoneMap["10.in-addr.arpa"]
+	if z == nil {
+		t.Fatalf("Failed to find zone for 10.in-addr.arpa")
+	}
+	if z.View != "" || fmt.Sprint(z.VRFs) != "[]" {
+		t.Errorf("10.in-addr.arpa wrong; got view %q VRFs %q", z.View, z.VRFs)
+	}
+
+	z = cfg.ZoneMap["lab/10.in-addr.arpa"]
+	if z == nil {
+		t.Fatalf("Failed to find zone for lab/10.in-addr.arpa")
+	}
+	if z.View != "lab" || fmt.Sprint(z.VRFs) != "[lab]" {
+		t.Errorf("lab/10.in-addr.arpa wrong; got view %q VRFs %q", z.View, z.VRFs)
+	}
+	if z.Key() != "lab/10.in-addr.arpa" {
+		t.Errorf("z.Key() wrong; got %q want %q", z.Key(), "lab/10.in-addr.arpa")
+	}
+}
+
+func TestParseSafety(t *testing.T) {
+	cfg, err := ParseConfig("testdata/config7/conf.yaml")
+	if err != nil {
+		t.Fatalf("Unable to parse config: %v", err)
+	}
+
+	z := cfg.ZoneMap["10.in-addr.arpa"]
+	if z.MaxDeletions != 0 || z.MaxDeletionPercent != 10 {
+		t.Errorf("10.in-addr.arpa limits wrong; got %d/%g want 0/10", z.MaxDeletions, z.MaxDeletionPercent)
+	}
+	z = cfg.ZoneMap["lab/10.in-addr.arpa"]
+	if z.MaxDeletions != 50 || z.MaxDeletionPercent != 10 {
+		t.Errorf("lab/10.in-addr.arpa limits wrong; got %d/%g want 50/10", z.MaxDeletions, z.MaxDeletionPercent)
+	}
+}
@@ -0,0 +1,146 @@
+package netbox2dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Change is a single rrset, or part of one, that `diff` reports and
+// `push` adds to, or removes from, a zone.  This is part of the JSON and YAML output
+// of `diff`, so fields should only be added, never renamed or
+// removed.
+type Change struct {
+	Zone     string   `json:"zone" yaml:"zone"`                     // Zone name, like "example.com"
+	View     string   `json:"view,omitempty" yaml:"view,omitempty"` // Zone view, if any
+	Provider string   `json:"provider" yaml:"provider"`             // Zone type, like "clouddns"
+	Action   string   `json:"action" yaml:"action"`                 // "add" or "remove"
+	Name     string   `json:"name" yaml:"name"`                     // Fully-qualified record name
+	Type     string   `json:"type" yaml:"type"`
+	TTL      int64    `json:"ttl" yaml:"ttl"`
+	Rrdatas  []string `json:"rrdatas" yaml:"rrdatas"`
+}
+
+// Change actions.
+const (
+	ActionAdd    = "add"
+	ActionRemove = "remove"
+)
+
+// Key returns the key of the zone that this change applies to in
+// Config.ZoneMap.
+func (c *Change) Key() string {
+	return zoneKey(c.View, c.Zone)
+}
+
+// Record returns the Record that this change adds or removes.
+func (c *Change) Record() *Record {
+	return &Record{
+		Name:    c.Name,
+		Type:    c.Type,
+		TTL:     c.TTL,
+		Rrdatas: slices.Clone(c.Rrdatas),
+	}
+}
+
+// Diff is the full set of changes between DNS and Netbox.
+type Diff struct {
+	Changes   []*Change `json:"changes" yaml:"changes"`
+	Removals  int       `json:"removals" yaml:"removals"`
+	Additions int       `json:"additions" yaml:"additions"`
+}
+
+// NewDiff builds a Diff from the results of Zones.Compare.  Only
+// records managed with cfg are removed; see Config.Managed.  Changes are
+// sorted by zone, then with removals before additions, then by name,
+// type, and rrdata, so the output is stable from run to run.
+func NewDiff(deltas []*ZoneDelta, cfg *Config) *Diff {
+	d := &Diff{Changes: []*Change{}}
+	managed := cfg.Managed()
+
+	for _, zd := range deltas {
+		provider := ""
+		if cz := cfg.ZoneMap[zd.Key()]; cz != nil {
+			provider = cz.ZoneType
+		}
+
+		add := func(action string, records map[string][]*Record) {
+			for _, rs := range records {
+				for _, r := range rs {
+					if action == ActionRemove && !r.IsManaged(managed) {
+						continue
+					}
+					d.Changes = append(d.Changes, &Change{
+						Zone:     zd.Name,
+						View:     zd.View,
+						Provider: provider,
+						Action:   action,
+						Name:     r.Name,
+						Type:     r.Type,
+						TTL:      r.TTL,
+						Rrdatas:  slices.Clone(r.Rrdatas),
+					})
+					if action == ActionRemove {
+						d.Removals++
+					} else {
+						d.Additions++
+					}
+				}
+			}
+		}
+		add(ActionRemove, zd.RemoveRecords)
+		add(ActionAdd, zd.AddRecords)
+	}
+
+	sort.SliceStable(d.Changes, func(i, j int) bool {
+		a, b := d.Changes[i], d.Changes[j]
+		if a.Key() != b.Key() {
+			return a.Key() < b.Key()
+		}
+		if a.Action != b.Action {
+			return a.Action == ActionRemove
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return strings.Join(a.Rrdatas, " ") < strings.Join(b.Rrdatas, " ")
+	})
+	return d
+}
+
+// Write writes the diff to w in the given format: "text", "json", or
+// "yaml".  The text format has one line per change, like
+// `+ www.example.com. A 300 [10.0.0.1]`.
+func (d *Diff) Write(w io.Writer, format string) error {
+	switch format {
+	case "text", "":
+		for _, c := range d.Changes {
+			sign := "+"
+			if c.Action == ActionRemove {
+				sign = "-"
+			}
+			_, err := fmt.Fprintf(w, "%s %s %s %d %v\n", sign, c.Name, c.Type, c.TTL, c.Rrdatas)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "json":
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(d)
+	case "yaml":
+		e := yaml.NewEncoder(w)
+		defer e.Close()
+		return e.Encode(d)
+	}
+	return fmt.Errorf("Unknown output format %q", format)
+}
@@ -0,0 +1,138 @@
+package netbox2dns
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func testDiff() *Diff {
+	cfg := &Config{ZoneMap: map[string]*ConfigZone{
+		"example.com":         {Name: "example.com", ZoneType: "clouddns"},
+		"lab/10.in-addr.arpa": {Name: "10.in-addr.arpa", ZoneType: "rfc2136", View: "lab"},
+	}}
+
+	fwd := &ZoneDelta{
+		Name: "example.com",
+		AddRecords: map[string][]*Record{
+			"b.example.com.": {{Name: "b.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.2"}}},
+			"a.example.com.": {{Name: "a.example.com.", Type: "AAAA", TTL: 300, Rrdatas: []string{"2001:db8::1"}}},
+		},
+		RemoveRecords: map[string][]*Record{
+			"c.example.com.": {
+				{Name: "c.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.3"}},
+				{Name: "c.example.com.", Type: "MX", TTL: 300, Rrdatas: []string{"10 mail.example.com."}},
+			},
+		},
+	}
+	rev := &ZoneDelta{
+		Name: "10.in-addr.arpa",
+		View: "lab",
+		AddRecords: map[string][]*Record{
+			"2.0.0.10.in-addr.arpa.": {{Name: "2.0.0.10.in-addr.arpa.", Type: "PTR", TTL: 300, Rrdatas: []string{"b.example.com."}}},
+		},
+		RemoveRecords: map[string][]*Record{},
+	}
+	return NewDiff([]*ZoneDelta{fwd, rev}, cfg)
+}
+
+func TestNewDiff(t *testing.T) {
+	d := testDiff()
+
+	if d.Additions != 3 || d.Removals != 1 {
+		t.Errorf("NewDiff() counts wrong; got %d additions, %d removals, want 3, 1", d.Additions, d.Removals)
+	}
+
+	want := []string{
+		"example.com remove c.example.com. A",
+		"example.com add a.example.com. AAAA",
+		"example.com add b.example.com. A",
+		"lab/10.in-addr.arpa add 2.0.0.10.in-addr.arpa. PTR",
+	}
+	if len(d.Changes) != len(want) {
+		t.Fatalf("NewDiff() got %d changes, want %d", len(d.Changes), len(want))
+	}
+	for i, c := range d.Changes {
+		got := c.Key() + " " + c.Action + " " + c.Name + " " + c.Type
+		if got != want[i] {
+			t.Errorf("NewDiff() change %d: got %q want %q", i, got, want[i])
+		}
+	}
+	if d.Changes[3].Provider != "rfc2136" {
+		t.Errorf("NewDiff() provider wrong; got %q want %q", d.Changes[3].Provider, "rfc2136")
+	}
+}
+
+func TestNewDiffManaged(t *testing.T) {
+	zd := &ZoneDelta{
+		Name:       "example.com",
+		AddRecords: map[string][]*Record{},
+		RemoveRecords: map[string][]*Record{
+			"www.example.com.": {{Name: "www.example.com.", Type: "CNAME", TTL: 300, Rrdatas: []string{"web1.example.com."}}},
+		},
+	}
+	zones := map[string]*ConfigZone{"example.com": {Name: "example.com", ZoneType: "clouddns"}}
+	cnameCfg := &Config{ZoneMap: zones}
+	cnameCfg.Naming.PrimaryNames = "cname"
+	plainCfg := &Config{ZoneMap: zones}
+
+	// Each config decides for itself; building one doesn't change
+	// the other.
+	for _, test := range []struct {
+		cfg  *Config
+		want int
+	}{{cnameCfg, 1}, {plainCfg, 0}, {cnameCfg, 1}} {
+		d := NewDiff([]*ZoneDelta{zd}, test.cfg)
+		if d.Removals != test.want {
+			t.Errorf("NewDiff(primary_names=%q) got %d CNAME removals, want %d", test.cfg.Naming.PrimaryNames, d.Removals, test.want)
+		}
+	}
+}
+
+func TestDiffWrite(t *testing.T) {
+	d := testDiff()
+
+	b := &bytes.Buffer{}
+	err := d.Write(b, "text")
+	if err != nil {
+		t.Fatalf("Write(text) returned error: %v", err)
+	}
+	want := "- c.example.com. A 300 [10.0.0.3]\n" +
+		"+ a.example.com. AAAA 300 [2001:db8::1]\n" +
+		"+ b.example.com. A 300 [10.0.0.2]\n" +
+		"+ 2.0.0.10.in-addr.arpa. PTR 300 [b.example.com.]\n"
+	if b.String() != want {
+		t.Errorf("Write(text) wrong; got:\n%s\nwant:\n%s", b.String(), want)
+	}
+
+	for _, format := range []string{"json", "yaml"} {
+		b.Reset()
+		err := d.Write(b, format)
+		if err != nil {
+			t.Fatalf("Write(%s) returned error: %v", format, err)
+		}
+
+		got := &Diff{}
+		if format == "json" {
+			err = json.Unmarshal(b.Bytes(), got)
+		} else {
+			err = yaml.Unmarshal(b.Bytes(), got)
+		}
+		if err != nil {
+			t.Fatalf("Unable to parse %s output: %v\n%s", format, err, b.String())
+		}
+		if len(got.Changes) != 4 || got.Additions != 3 || got.Removals != 1 {
+			t.Errorf("Write(%s) round trip wrong; got %+v", format, got)
+		}
+		c := got.Changes[3]
+		if c.Zone != "10.in-addr.arpa" || c.View != "lab" || c.Action != "add" || c.Rrdatas[0] != "b.example.com." {
+			t.Errorf("Write(%s) change wrong; got %+v", format, c)
+		}
+	}
+
+	if d.Write(b, "xml") == nil {
+		t.Errorf("Write(xml) succeeded, want error")
+	}
+}
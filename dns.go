@@ -5,17 +5,23 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/golang/glog"
+	"golang.org/x/sync/errgroup"
 )
 
-// DNSProvider is an interface to a DNS provider backend, such a CloudDNS or ZoneFile.
+// DNSProvider is an interface to a DNS provider backend, such a CloudDNS, ZoneFile, RFC2136, or PowerDNS.
+//
+// Every method takes a context, and should give up and return an error
+// once the context is done.  Providers that queue changes until Save
+// is called can ignore it in WriteRecord and RemoveRecord.
 type DNSProvider interface {
-	ImportZone(cz *ConfigZone) (*Zone, error)
-	WriteRecord(cz *ConfigZone, r *Record) error
-	RemoveRecord(cz *ConfigZone, r *Record) error
-	Save(cz *ConfigZone) error
+	ImportZone(ctx context.Context, cz *ConfigZone) (*Zone, error)
+	WriteRecord(ctx context.Context, cz *ConfigZone, r *Record) error
+	RemoveRecord(ctx context.Context, cz *ConfigZone, r *Record) error
+	Save(ctx context.Context, cz *ConfigZone) error
 }
 
 // NewDNSProvider creates a provider of the correct type for the described zone.
@@ -25,29 +31,225 @@ func NewDNSProvider(ctx context.Context, cz *ConfigZone) (DNSProvider, error) {
 		return NewCloudDNS(ctx, cz)
 	case "zonefile":
 		return NewZoneFileDNS(ctx, cz)
+	case "rfc2136":
+		return NewRFC2136DNS(ctx, cz)
+	case "powerdns":
+		return NewPowerDNS(ctx, cz)
 	default:
 		return nil, fmt.Errorf("Unknown DNS provider type %q", cz.ZoneType)
 	}
 }
 
 // ImportZones creates new DNS providers for each zone and imports all
-// existing records for each zone.
+// existing records for each zone.  It fails if any zone fails.
 func ImportZones(ctx context.Context, cfg *Config) (*Zones, error) {
-	zones := NewZones()
+	providers, err := NewProviders(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return providers.ImportZones(ctx, cfg)
+}
+
+// Providers holds a DNSProvider for each zone in the config, keyed by
+// zone key (see ConfigZone.Key).  Changes should be pushed with the
+// same providers that imported the zones, as some providers use the
+// imported records when saving changes.
+type Providers map[string]DNSProvider
+
+// NewProviders creates a DNSProvider for each zone in the config.  API
+// calls are retried and rate limited as described by the `retry` and
+// `rate_limits` config settings.  If some zones fail, then the rest are
+// still created and a ZoneErrors is returned.  Failed zones get a
+// provider that returns the same error from every method, so they fail
+// again when they're used.
+func NewProviders(ctx context.Context, cfg *Config) (Providers, error) {
+	callers, err := newAPICallers(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, cz := range cfg.ZoneMap {
+	managed := cfg.Managed()
+	providers := make(Providers)
+	errs := make(ZoneErrors)
+	for k, cz := range cfg.ZoneMap {
 		provider, err := NewDNSProvider(ctx, cz)
 		if err != nil {
-			return nil, fmt.Errorf("Unable to get provider for zone %q: %v", cz.Name, err)
+			err = fmt.Errorf("Unable to get provider for zone %q: %v", k, err)
+			providerErrors.WithLabelValues(k, cz.ZoneType, "create").Inc()
+			provider = &failedProvider{err: err}
+			errs.add(k, err)
+		}
+		if u, ok := provider.(apiCallerUser); ok {
+			u.setAPICaller(callers[cz.ZoneType])
+		}
+		if u, ok := provider.(managedUser); ok {
+			u.setManaged(managed)
+		}
+		providers[k] = provider
+	}
+	return providers, errs.orNil()
+}
+
+// failedProvider stands in for a DNSProvider that couldn't be created.
+type failedProvider struct {
+	err error
+}
+
+func (fp *failedProvider) ImportZone(ctx context.Context, cz *ConfigZone) (*Zone, error) {
+	return nil, fp.err
+}
+func (fp *failedProvider) WriteRecord(ctx context.Context, cz *ConfigZone, r *Record) error {
+	return fp.err
+}
+func (fp *failedProvider) RemoveRecord(ctx context.Context, cz *ConfigZone, r *Record) error {
+	return fp.err
+}
+func (fp *failedProvider) Save(ctx context.Context, cz *ConfigZone) error { return fp.err }
+
+// ImportZones imports all existing records for each zone, with up to
+// cfg.Concurrency zones at a time.  Zones that fail to import are left
+// out, and a ZoneErrors is returned along with the zones that worked.
+// Once ctx is done, no more zones are started.
+func (p Providers) ImportZones(ctx context.Context, cfg *Config) (*Zones, error) {
+	zones := NewZones()
+	errs := make(ZoneErrors)
+	var mu sync.Mutex
+
+	g := &errgroup.Group{}
+	g.SetLimit(cfg.workers())
+	for k, cz := range cfg.ZoneMap {
+		k, cz := k, cz
+		g.Go(func() error {
+			zone, err := p.importZone(ctx, k, cz)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs.add(k, err)
+				return nil
+			}
+			zones.AddZone(zone)
+			return nil
+		})
+	}
+	g.Wait()
+	return zones, errs.orNil()
+}
+
+// importZone imports a single zone.
+func (p Providers) importZone(ctx context.Context, k string, cz *ConfigZone) (*Zone, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("Not imported: %v", err)
+	}
+	provider := p[k]
+	if provider == nil {
+		return nil, fmt.Errorf("No provider for zone %q", k)
+	}
+	zone, err := provider.ImportZone(ctx, cz)
+	if err != nil {
+		providerErrors.WithLabelValues(k, cz.ZoneType, "import").Inc()
+		return nil, fmt.Errorf("Unable to import zone: %v", err)
+	}
+	zone.View = cz.View
+	zone.VRFs = cz.VRFs
+	return zone, nil
+}
+
+// Apply pushes every change in a Diff to DNS, and records what
+// happened in report.  Up to cfg.Concurrency zones are pushed at a
+// time; each zone's changes are sent to its provider in order and then
+// saved.  A failure in one zone doesn't stop the others, and zones
+// that have already failed in report are skipped.  Once ctx is done,
+// no more changes are started, and zones that didn't finish are marked
+// as failed.  Returns report.Err().
+func (p Providers) Apply(ctx context.Context, cfg *Config, d *Diff, report *Report) error {
+	keys := []string{}
+	changes := make(map[string][]*Change)
+	for _, c := range d.Changes {
+		if changes[c.Key()] == nil {
+			keys = append(keys, c.Key())
+		}
+		changes[c.Key()] = append(changes[c.Key()], c)
+	}
+
+	g := &errgroup.Group{}
+	g.SetLimit(cfg.workers())
+	for _, k := range keys {
+		k := k
+		g.Go(func() error {
+			p.applyZone(ctx, cfg, k, changes[k], report)
+			return nil
+		})
+	}
+	g.Wait()
+	return report.Err()
+}
+
+// changeDiscarder is implemented by providers that queue changes
+// until Save.  applyZone uses it to drop the changes for a zone that it
+// gives up on, since providers are reused by later runs.
+type changeDiscarder interface {
+	discardChanges(cz *ConfigZone)
+}
+
+// applyZone pushes the changes for a single zone.
+func (p Providers) applyZone(ctx context.Context, cfg *Config, k string, changes []*Change, report *Report) {
+	cz := cfg.ZoneMap[k]
+	provider := p[k]
+	if cz == nil || provider == nil {
+		report.ZoneError(k, fmt.Errorf("Zone %q isn't in the config", k))
+		return
+	}
+	if report.zoneFailed(k) {
+		return
+	}
+
+	// Providers only queue changes until Save, so nothing counts as
+	// applied until then.
+	queued := []*Change{}
+	for _, c := range changes {
+		if err := ctx.Err(); err != nil {
+			// Don't save a half-finished zone, or leave its
+			// changes queued for the next Save.
+			if d, ok := provider.(changeDiscarder); ok {
+				d.discardChanges(cz)
+			}
+			report.ZoneError(k, fmt.Errorf("Push interrupted: %v", err))
+			return
+		}
+
+		var err error
+		if c.Action == ActionRemove {
+			err = provider.RemoveRecord(ctx, cz, c.Record())
+			if err != nil {
+				log.Errorf("Failed to remove record: %v", err)
+			}
+		} else {
+			err = provider.WriteRecord(ctx, cz, c.Record())
+			if err != nil {
+				log.Errorf("Failed to update record: %v", err)
+			}
 		}
-		zone, err := provider.ImportZone(cz)
 		if err != nil {
-			return nil, fmt.Errorf("Unable to get import zone: %v", err)
+			providerErrors.WithLabelValues(k, cz.ZoneType, c.Action).Inc()
+			report.changeFailed(c, err)
+		} else {
+			queued = append(queued, c)
 		}
+	}
 
-		zones.AddZone(zone)
+	err := provider.Save(ctx, cz)
+	if err != nil {
+		log.Errorf("Failed to save zone %q: %v", k, err)
+		providerErrors.WithLabelValues(k, cz.ZoneType, "save").Inc()
+		report.ZoneError(k, fmt.Errorf("Failed to save zone: %v", err))
+		return
+	}
+	for _, c := range queued {
+		zoneChangesApplied.WithLabelValues(k, cz.ZoneType, c.Action).Inc()
+		report.changeApplied(c)
 	}
-	return zones, nil
+	report.zoneDone(k)
 }
 
 // IncrementSerial increments the serial number on a DNS zone.  This
@@ -1,7 +1,13 @@
 package netbox2dns
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type serials struct {
@@ -40,3 +46,121 @@ func TestIncrementSerial(t *testing.T) {
 		}
 	}
 }
+
+func TestProvidersApply(t *testing.T) {
+	filename := copyZoneFile(t, "example.com.zone")
+	cfg := &Config{ZoneMap: map[string]*ConfigZone{
+		"example.com": {ZoneType: "zonefile", Name: "example.com", Filename: filename, TTL: 300},
+	}}
+
+	providers, err := NewProviders(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("NewProviders() returned error: %v", err)
+	}
+	zones, err := providers.ImportZones(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("ImportZones() returned error: %v", err)
+	}
+	before := zones.Zones["example.com"].Fingerprint()
+
+	d := &Diff{Changes: []*Change{
+		{Zone: "example.com", Action: ActionAdd, Name: "new.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.9.9.9"}},
+	}}
+	err = providers.Apply(context.Background(), cfg, d, NewReport(cfg))
+	if err != nil {
+		t.Fatalf("Apply() returned error: %v", err)
+	}
+
+	// Importing again with the same providers should see the change.
+	zones, err = providers.ImportZones(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("ImportZones() returned error: %v", err)
+	}
+	if findRecord(zones.Zones["example.com"], "new.example.com.", "A") == nil {
+		t.Errorf("Added record missing after Apply()")
+	}
+	if zones.Zones["example.com"].Fingerprint() == before {
+		t.Errorf("Fingerprint unchanged after Apply()")
+	}
+
+	// So should changes made to the file by hand.
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Unable to open zone file: %v", err)
+	}
+	f.WriteString("manual.example.com. 300 IN A 10.8.8.8\n")
+	f.Close()
+
+	zones, err = providers.ImportZones(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("ImportZones() returned error: %v", err)
+	}
+	if findRecord(zones.Zones["example.com"], "manual.example.com.", "A") == nil {
+		t.Errorf("ImportZones() didn't re-read the zone file")
+	}
+
+	// Changes for zones that aren't in the config fail.
+	d.Changes[0].Zone = "example.net"
+	if providers.Apply(context.Background(), cfg, d, NewReport(cfg)) == nil {
+		t.Errorf("Apply() to an unknown zone succeeded, want error")
+	}
+}
+
+// slowProvider is a DNSProvider that records how many calls are in
+// progress at once.
+type slowProvider struct {
+	flakyProvider
+	running, peak *atomic.Int32
+}
+
+func (sp *slowProvider) ImportZone(ctx context.Context, cz *ConfigZone) (*Zone, error) {
+	n := sp.running.Add(1)
+	defer sp.running.Add(-1)
+	for {
+		p := sp.peak.Load()
+		if n <= p || sp.peak.CompareAndSwap(p, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return sp.flakyProvider.ImportZone(ctx, cz)
+}
+
+func TestImportZonesConcurrency(t *testing.T) {
+	running, peak := &atomic.Int32{}, &atomic.Int32{}
+	cfg := &Config{Concurrency: 3, ZoneMap: make(map[string]*ConfigZone)}
+	providers := make(Providers)
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("z%d.example", i)
+		cfg.ZoneMap[name] = &ConfigZone{ZoneType: "test", Name: name}
+		providers[name] = &slowProvider{running: running, peak: peak}
+	}
+
+	zones, err := providers.ImportZones(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("ImportZones() returned error: %v", err)
+	}
+	if len(zones.Zones) != 10 {
+		t.Errorf("ImportZones() returned %d zones, want 10", len(zones.Zones))
+	}
+	if peak.Load() > 3 || peak.Load() < 2 {
+		t.Errorf("ImportZones() ran %d zones at once, want 2-3", peak.Load())
+	}
+
+	// Nothing is imported once the context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	zones, err = providers.ImportZones(ctx, cfg)
+	var ze ZoneErrors
+	if !errors.As(err, &ze) || len(ze) != 10 || len(zones.Zones) != 0 {
+		t.Errorf("ImportZones() with a canceled context wrong; got %d zones, %v", len(zones.Zones), err)
+	}
+
+	// Or pushed.
+	report := NewReport(cfg)
+	d := &Diff{Changes: []*Change{{Zone: "z1.example", Action: ActionAdd, Name: "a.z1.example.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.1"}}}}
+	providers.Apply(ctx, cfg, d, report)
+	if report.Zone("z1.example").Status != StatusFailed || providers["z1.example"].(*slowProvider).saved {
+		t.Errorf("Apply() with a canceled context wrong; got %+v", report.Zone("z1.example"))
+	}
+}
@@ -0,0 +1,155 @@
+package netbox2dns
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/netbox-community/go-netbox/v3/netbox/client/ipam"
+)
+
+// Filter decides which Netbox IP addresses are added to DNS.  It's
+// built from a `filters` section in the config file.  See `#Filter` in
+// `config.cue` for details.
+type Filter struct {
+	cfg             ConfigFilter
+	prefixes        []netip.Prefix
+	excludePrefixes []netip.Prefix
+}
+
+// DefaultFilter returns the filter used when no `filters` are
+// configured; it accepts all active and DHCP addresses.
+func DefaultFilter() *Filter {
+	return &Filter{
+		cfg: ConfigFilter{Status: []string{"active", "dhcp"}},
+	}
+}
+
+// NewFilter creates a new Filter from a ConfigFilter.  A nil
+// ConfigFilter returns a nil Filter, which matches everything.
+func NewFilter(cf *ConfigFilter) (*Filter, error) {
+	if cf == nil {
+		return nil, nil
+	}
+
+	f := &Filter{cfg: *cf}
+	var err error
+	f.prefixes, err = parsePrefixes(cf.Prefixes)
+	if err != nil {
+		return nil, err
+	}
+	f.excludePrefixes, err = parsePrefixes(cf.ExcludePrefixes)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parsePrefixes(prefixes []string) ([]netip.Prefix, error) {
+	ret := make([]netip.Prefix, len(prefixes))
+	for i, p := range prefixes {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse filter prefix %q: %v", p, err)
+		}
+		ret[i] = prefix.Masked()
+	}
+	return ret, nil
+}
+
+// Match returns true if an IP address passes the filter.  Each
+// non-empty include list (tags, tenants, and so on) must contain at
+// least one of the address's values, and no exclude list may contain
+// any of them.  A nil Filter matches every address.
+func (f *Filter) Match(addr *IPAddr) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.cfg.Status) > 0 && !slices.Contains(f.cfg.Status, addr.Status) {
+		return false
+	}
+	if len(f.cfg.Tenants) > 0 && !slices.Contains(f.cfg.Tenants, addr.Tenant) {
+		return false
+	}
+	if slices.Contains(f.cfg.ExcludeTenants, addr.Tenant) {
+		return false
+	}
+	if len(f.cfg.VRFs) > 0 && !slices.Contains(f.cfg.VRFs, addr.VRF) {
+		return false
+	}
+	if slices.Contains(f.cfg.ExcludeVRFs, addr.VRF) {
+		return false
+	}
+	if len(f.cfg.Roles) > 0 && !slices.Contains(f.cfg.Roles, addr.Role) {
+		return false
+	}
+	if slices.Contains(f.cfg.ExcludeRoles, addr.Role) {
+		return false
+	}
+
+	if len(f.cfg.Tags) > 0 {
+		found := false
+		for _, t := range f.cfg.Tags {
+			if addr.Tags[t] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, t := range f.cfg.ExcludeTags {
+		if addr.Tags[t] {
+			return false
+		}
+	}
+
+	a := addr.Address.Addr()
+	if len(f.prefixes) > 0 && !prefixesContain(f.prefixes, a) {
+		return false
+	}
+	if prefixesContain(f.excludePrefixes, a) {
+		return false
+	}
+	return true
+}
+
+// QueryParams adds the parts of the filter that Netbox can evaluate
+// to a Netbox API query.  The API client only allows a single value
+// per parameter, so lists with more than one entry are only checked
+// by Match.  VRFs are always checked by Match, as Netbox's `vrf`
+// parameter matches on route distinguisher rather than name.
+func (f *Filter) QueryParams(p *ipam.IpamIPAddressesListParams) {
+	if f == nil {
+		return
+	}
+	p.Status = single(f.cfg.Status)
+	p.Tag = single(f.cfg.Tags)
+	p.Tagn = single(f.cfg.ExcludeTags)
+	p.Tenant = single(f.cfg.Tenants)
+	p.Tenantn = single(f.cfg.ExcludeTenants)
+	p.Role = single(f.cfg.Roles)
+	p.Rolen = single(f.cfg.ExcludeRoles)
+	p.Parent = single(f.cfg.Prefixes)
+}
+
+// single returns a pointer to the only item in l, or nil if l doesn't
+// have exactly one item.  Empty strings are used to match "no value"
+// in filters, which Netbox can't express, so they return nil too.
+func single(l []string) *string {
+	if len(l) != 1 || l[0] == "" {
+		return nil
+	}
+	return &l[0]
+}
+
+func prefixesContain(prefixes []netip.Prefix, a netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package netbox2dns
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/netbox-community/go-netbox/v3/netbox/client/ipam"
+)
+
+func TestFilterMatch(t *testing.T) {
+	addr := &IPAddr{
+		Address: netip.MustParsePrefix("10.1.2.3/24"),
+		Status:  "active",
+		Tenant:  "ops",
+		VRF:     "prod",
+		Tags:    map[string]bool{"dns": true},
+	}
+
+	tests := []struct {
+		name   string
+		filter *ConfigFilter
+		want   bool
+	}{
+		{"nil", nil, true},
+		{"empty", &ConfigFilter{}, true},
+		{"status", &ConfigFilter{Status: []string{"active", "dhcp"}}, true},
+		{"status-miss", &ConfigFilter{Status: []string{"reserved"}}, false},
+		{"tags", &ConfigFilter{Tags: []string{"other", "dns"}}, true},
+		{"tags-miss", &ConfigFilter{Tags: []string{"other"}}, false},
+		{"exclude-tags", &ConfigFilter{ExcludeTags: []string{"dns"}}, false},
+		{"tenants", &ConfigFilter{Tenants: []string{"ops"}}, true},
+		{"exclude-tenants", &ConfigFilter{ExcludeTenants: []string{"ops"}}, false},
+		{"vrfs", &ConfigFilter{VRFs: []string{"prod"}}, true},
+		{"vrfs-global", &ConfigFilter{VRFs: []string{""}}, false},
+		{"exclude-vrfs", &ConfigFilter{ExcludeVRFs: []string{"lab"}}, true},
+		{"roles-none", &ConfigFilter{Roles: []string{""}}, true},
+		{"exclude-roles", &ConfigFilter{ExcludeRoles: []string{"anycast"}}, true},
+		{"prefixes", &ConfigFilter{Prefixes: []string{"10.0.0.0/8"}}, true},
+		{"prefixes-miss", &ConfigFilter{Prefixes: []string{"192.168.0.0/16"}}, false},
+		{"exclude-prefixes", &ConfigFilter{ExcludePrefixes: []string{"10.1.2.0/24"}}, false},
+	}
+
+	for _, test := range tests {
+		f, err := NewFilter(test.filter)
+		if err != nil {
+			t.Fatalf("NewFilter(%s) returned error: %v", test.name, err)
+		}
+		got := f.Match(addr)
+		if got != test.want {
+			t.Errorf("Match(%s): got %v want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestFilterBadPrefix(t *testing.T) {
+	_, err := NewFilter(&ConfigFilter{Prefixes: []string{"10.0.0.0"}})
+	if err == nil {
+		t.Errorf("NewFilter() with an invalid prefix succeeded, want error")
+	}
+}
+
+func TestFilterQueryParams(t *testing.T) {
+	f, err := NewFilter(&ConfigFilter{
+		Status:      []string{"active", "dhcp"},
+		Tags:        []string{"dns"},
+		ExcludeTags: []string{"lab"},
+		VRFs:        []string{"prod"},
+		Prefixes:    []string{"10.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatalf("NewFilter() returned error: %v", err)
+	}
+
+	p := ipam.NewIpamIPAddressesListParams()
+	f.QueryParams(p)
+
+	if p.Status != nil {
+		t.Errorf("p.Status wrong; got %q want nil", *p.Status)
+	}
+	if p.Tag == nil || *p.Tag != "dns" {
+		t.Errorf("p.Tag wrong; got %v want \"dns\"", p.Tag)
+	}
+	if p.Tagn == nil || *p.Tagn != "lab" {
+		t.Errorf("p.Tagn wrong; got %v want \"lab\"", p.Tagn)
+	}
+	if p.Vrf != nil {
+		t.Errorf("p.Vrf wrong; got %q want nil", *p.Vrf)
+	}
+	if p.Parent == nil || *p.Parent != "10.0.0.0/8" {
+		t.Errorf("p.Parent wrong; got %v want \"10.0.0.0/8\"", p.Parent)
+	}
+}
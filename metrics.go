@@ -0,0 +1,100 @@
+package netbox2dns
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics.  Per-zone metrics are labeled with the zone key
+// (see ConfigZone.Key) and the zone type.
+var (
+	zoneRecordsImported = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "netbox2dns_zone_records_imported",
+		Help: "Number of records found in each zone at the last sync.",
+	}, []string{"zone", "provider"})
+	zoneRecordsDesired = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "netbox2dns_zone_records_desired",
+		Help: "Number of records that Netbox wants in each zone at the last sync.",
+	}, []string{"zone", "provider"})
+	zoneChangesPending = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "netbox2dns_zone_changes_pending",
+		Help: "Number of records that needed to be added or removed at the last sync.",
+	}, []string{"zone", "provider", "action"})
+	zoneChangesApplied = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netbox2dns_zone_changes_applied_total",
+		Help: "Number of records added to or removed from each zone.",
+	}, []string{"zone", "provider", "action"})
+	providerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netbox2dns_provider_errors_total",
+		Help: "Number of failed DNS provider operations.",
+	}, []string{"zone", "provider", "operation"})
+	providerRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netbox2dns_provider_retries_total",
+		Help: "Number of DNS provider API calls that were retried.",
+	}, []string{"provider"})
+	zoneSOASerial = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "netbox2dns_zone_soa_serial",
+		Help: "SOA serial number of each zonefile zone.",
+	}, []string{"zone"})
+
+	netboxFetchSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "netbox2dns_netbox_fetch_duration_seconds",
+		Help:    "Time taken to fetch data from Netbox.",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 10),
+	}, []string{"object"})
+	netboxIPAddresses = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "netbox2dns_netbox_ip_addresses",
+		Help: "Number of IP addresses fetched from Netbox at the last sync.",
+	})
+
+	syncRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "netbox2dns_sync_runs_total",
+		Help: "Number of full syncs, by result: ok, partial, or failed.",
+	}, []string{"result"})
+	syncLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "netbox2dns_sync_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful full sync.",
+	})
+)
+
+// MetricsHandler returns an http.Handler that serves Prometheus
+// metrics.
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// observeFetch records how long a Netbox fetch took.
+func observeFetch(object string, start time.Time) {
+	netboxFetchSeconds.WithLabelValues(object).Observe(time.Since(start).Seconds())
+}
+
+// countRecords returns the number of rrsets in a zone.  Each Record
+// counts once, however many rrdatas it has.
+func countRecords(zone *Zone) int {
+	if zone == nil {
+		return 0
+	}
+	n := 0
+	for _, records := range zone.Records {
+		n += len(records)
+	}
+	return n
+}
+
+// recordZoneMetrics records the size of each zone before and after a
+// sync, and the number of changes that it needs.
+func recordZoneMetrics(cfg *Config, imported, desired *Zones, d *Diff) {
+	for k, cz := range cfg.ZoneMap {
+		zoneRecordsImported.WithLabelValues(k, cz.ZoneType).Set(float64(countRecords(imported.Zones[k])))
+		zoneRecordsDesired.WithLabelValues(k, cz.ZoneType).Set(float64(countRecords(desired.Zones[k])))
+		zoneChangesPending.WithLabelValues(k, cz.ZoneType, ActionAdd).Set(0)
+		zoneChangesPending.WithLabelValues(k, cz.ZoneType, ActionRemove).Set(0)
+	}
+	for _, c := range d.Changes {
+		zoneChangesPending.WithLabelValues(c.Key(), c.Provider, c.Action).Inc()
+	}
+}
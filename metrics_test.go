@@ -0,0 +1,61 @@
+package netbox2dns
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestApplyMetrics(t *testing.T) {
+	filename := copyZoneFile(t, "example.com.zone")
+	cfg := &Config{ZoneMap: map[string]*ConfigZone{
+		"metrics.example.com": {ZoneType: "zonefile", Name: "metrics.example.com", Filename: filename, TTL: 300},
+	}}
+
+	providers, err := NewProviders(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("NewProviders() returned error: %v", err)
+	}
+	zones, err := providers.ImportZones(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("ImportZones() returned error: %v", err)
+	}
+	serial := testutil.ToFloat64(zoneSOASerial.WithLabelValues("metrics.example.com"))
+	if serial == 0 {
+		t.Errorf("SOA serial metric not set by ImportZones()")
+	}
+
+	d := &Diff{Changes: []*Change{
+		{Zone: "metrics.example.com", Provider: "zonefile", Action: ActionAdd, Name: "new.metrics.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.9.9.9"}},
+		{Zone: "metrics.example.com", Provider: "zonefile", Action: ActionAdd, Name: "new2.metrics.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.9.9.8"}},
+	}}
+	recordZoneMetrics(cfg, zones, zones, d)
+	if got := testutil.ToFloat64(zoneChangesPending.WithLabelValues("metrics.example.com", "zonefile", ActionAdd)); got != 2 {
+		t.Errorf("Pending adds wrong; got %v want 2", got)
+	}
+	if got := testutil.ToFloat64(zoneRecordsImported.WithLabelValues("metrics.example.com", "zonefile")); got != float64(countRecords(zones.Zones["metrics.example.com"])) {
+		t.Errorf("Imported records wrong; got %v", got)
+	}
+
+	err = providers.Apply(context.Background(), cfg, d, NewReport(cfg))
+	if err != nil {
+		t.Fatalf("Apply() returned error: %v", err)
+	}
+	if got := testutil.ToFloat64(zoneChangesApplied.WithLabelValues("metrics.example.com", "zonefile", ActionAdd)); got != 2 {
+		t.Errorf("Applied adds wrong; got %v want 2", got)
+	}
+	if got := testutil.ToFloat64(zoneSOASerial.WithLabelValues("metrics.example.com")); got <= serial {
+		t.Errorf("SOA serial metric not updated by Save(); got %v, was %v", got, serial)
+	}
+
+	w := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(w.Body)
+	if !strings.Contains(string(body), `netbox2dns_zone_changes_applied_total{action="add",provider="zonefile",zone="metrics.example.com"} 2`) {
+		t.Errorf("MetricsHandler() output missing applied changes:\n%s", body)
+	}
+}
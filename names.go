@@ -0,0 +1,153 @@
+package netbox2dns
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"text/template"
+)
+
+// NameTemplateData is passed to `name_template` templates when
+// generating a DNS name for an IP address.  Fields describing the
+// interface and device or VM are empty if the address isn't assigned
+// to an interface.
+type NameTemplateData struct {
+	Address   netip.Addr // The IP address, without a prefix length
+	IP        *IPAddr    // The full Netbox IP address
+	DNSName   string     // The IP address's `dns_name`, if any
+	Interface string     // Interface name
+	Device    string     // Device or VM name
+	IsVM      bool       // True if Device is a virtual machine
+	Site      string     // Site slug
+	Cluster   string     // Cluster name, for VMs
+	Tenant    string     // Device or VM tenant slug
+	Role      string     // Device or VM role slug
+}
+
+// nameTemplateFuncs are the extra functions available to
+// `name_template` templates.
+var nameTemplateFuncs = template.FuncMap{
+	// label turns any string into a valid DNS label.
+	"label": DNSLabel,
+	// dashed turns an IP address into a DNS label, like "10-0-0-1".
+	"dashed": func(a netip.Addr) string {
+		return DNSLabel(a.String())
+	},
+	"lower":   strings.ToLower,
+	"replace": strings.ReplaceAll,
+}
+
+// ParseNameTemplate parses a `name_template` from the config file.
+// An empty template returns nil.
+func ParseNameTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	t, err := template.New(name).Funcs(nameTemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse name_template for %q: %v", name, err)
+	}
+	return t, nil
+}
+
+// nameTemplateData builds the data passed to name templates for an IP
+// address.
+func (z *Zones) nameTemplateData(addr *IPAddr) *NameTemplateData {
+	d := &NameTemplateData{
+		Address: addr.Address.Addr(),
+		IP:      addr,
+		DNSName: addr.DNSName,
+	}
+	if in := z.Hosts.InterfaceFor(addr); in != nil {
+		d.Interface = in.Name
+		if in.Host != nil {
+			d.Device = in.Host.Name
+			d.IsVM = in.Host.IsVM
+			d.Site = in.Host.Site
+			d.Cluster = in.Host.Cluster
+			d.Tenant = in.Host.Tenant
+			d.Role = in.Host.Role
+		}
+	}
+	return d
+}
+
+// nameTemplateFor returns the name template that applies to an IP
+// address, and whether it should override `dns_name`.  Templates set
+// on a zone apply to addresses whose reverse DNS name is in that
+// zone, using the first matching view that has a template; the
+// template in `defaults` applies to everything else.
+func (z *Zones) nameTemplateFor(addr *IPAddr) (*template.Template, bool) {
+	for _, zone := range z.FindZones(ReverseName(addr.Address.Addr()), addr.VRF) {
+		if zone.NameTemplate != nil {
+			return zone.NameTemplate, zone.NameTemplateOverride
+		}
+	}
+	return z.NameTemplate, z.NameTemplateOverride
+}
+
+// TemplateName generates a DNS name for an IP address using the
+// applicable `name_template`.  It returns "" if no template applies
+// or if the template produced an empty name.
+func (z *Zones) TemplateName(addr *IPAddr, t *template.Template) (string, error) {
+	b := &strings.Builder{}
+	err := t.Execute(b, z.nameTemplateData(addr))
+	if err != nil {
+		return "", fmt.Errorf("Unable to generate name for %s: %v", addr.Address.Addr(), err)
+	}
+	return strings.Trim(strings.TrimSpace(b.String()), "."), nil
+}
+
+// GeneratedName builds a DNS name for an IP address from the device
+// or virtual machine interface that it's assigned to.  Device
+// interfaces are named `<interface>.<device>.<site>.<device_domain>`
+// and VM interfaces are named `<vm>.<cluster>.<vm_domain>`.  If the
+// address isn't assigned to an interface, or the corresponding domain
+// isn't configured, then "" is returned.
+func (z *Zones) GeneratedName(addr *IPAddr) string {
+	in := z.Hosts.InterfaceFor(addr)
+	if in == nil || in.Host == nil {
+		return ""
+	}
+
+	labels := []string{}
+	domain := ""
+	if in.Host.IsVM {
+		labels = append(labels, in.Host.Name, in.Host.Cluster)
+		domain = z.Naming.VMDomain
+	} else {
+		labels = append(labels, in.Name, in.Host.Name, in.Host.Site)
+		domain = z.Naming.DeviceDomain
+	}
+	if domain == "" {
+		return ""
+	}
+
+	name := []string{}
+	for _, l := range labels {
+		if l := DNSLabel(l); l != "" {
+			name = append(name, l)
+		}
+	}
+	name = append(name, strings.Trim(domain, "."))
+	return strings.Join(name, ".")
+}
+
+// DNSLabel converts a Netbox object name (like "GigabitEthernet0/0/1.100")
+// into a valid DNS label (like "gigabitethernet0-0-1-100").
+func DNSLabel(s string) string {
+	b := strings.Builder{}
+	dash := false
+	for _, c := range strings.ToLower(s) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteRune('-')
+			}
+			b.WriteRune(c)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,91 @@
+package netbox2dns
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestDNSLabel(t *testing.T) {
+	tests := map[string]string{
+		"router1":                  "router1",
+		"GigabitEthernet0/0/1.100": "gigabitethernet0-0-1-100",
+		"ge-0/0/0":                 "ge-0-0-0",
+		"  eth0  ":                 "eth0",
+		"Site_A--North":            "site-a-north",
+		"/":                        "",
+	}
+	for in, want := range tests {
+		got := DNSLabel(in)
+		if got != want {
+			t.Errorf("DNSLabel(%q): got %q want %q", in, got, want)
+		}
+	}
+}
+
+func TestNameTemplate(t *testing.T) {
+	cfg := &Config{}
+	cfg.Defaults.NameTemplate = "{{label .Interface}}.{{label .Device}}.{{.Site}}.example.com"
+	cfg.ZoneMap = map[string]*ConfigZone{
+		"example.com":     {Name: "example.com", TTL: 300},
+		"10.in-addr.arpa": {Name: "10.in-addr.arpa", TTL: 300},
+		"1.0.10.in-addr.arpa": {
+			Name:                 "1.0.10.in-addr.arpa",
+			TTL:                  300,
+			NameTemplate:         "{{if .Device}}{{.Device}}.{{.Cluster}}{{else}}ip-{{dashed .Address}}{{end}}.example.com.",
+			NameTemplateOverride: true,
+		},
+	}
+
+	z, err := NewZonesFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewZonesFromConfig() returned error: %v", err)
+	}
+	z.Hosts = testHosts()
+
+	addrs := IPAddrs{
+		// Uses the default template
+		{Address: netip.MustParsePrefix("10.0.0.1/24"), Status: "active", AssignedObjectType: "dcim.interface", AssignedObjectID: 10},
+		// dns_name wins over the default template
+		{Address: netip.MustParsePrefix("10.0.0.2/24"), Status: "active", AssignedObjectType: "dcim.interface", AssignedObjectID: 10, DNSName: "router1.example.com"},
+		// Uses the override template from 1.0.10.in-addr.arpa
+		{Address: netip.MustParsePrefix("10.0.1.1/24"), Status: "active", AssignedObjectType: "virtualization.vminterface", AssignedObjectID: 20, DNSName: "ignored.example.com"},
+		{Address: netip.MustParsePrefix("10.0.1.2/24"), Status: "active"},
+	}
+	err = z.AddAddrs(addrs)
+	if err != nil {
+		t.Fatalf("AddAddrs() returned error: %v", err)
+	}
+
+	want := map[string]string{
+		"1.0.0.10.in-addr.arpa.": "xe-0-0-0-100.router1.sea1.example.com.",
+		"2.0.0.10.in-addr.arpa.": "router1.example.com.",
+		"1.1.0.10.in-addr.arpa.": "web1.prod.example.com.",
+		"2.1.0.10.in-addr.arpa.": "ip-10-0-1-2.example.com.",
+	}
+	for rev, name := range want {
+		zone := z.FindZone(rev)
+		if zone == nil {
+			t.Fatalf("FindZone(%q) returned nil", rev)
+		}
+		r := zone.Records[rev]
+		if len(r) != 1 || r[0].Rrdatas[0] != name {
+			t.Errorf("PTR for %q: got %+v, want %q", rev, r, name)
+		}
+		if z.Zones["example.com"].Records[name] == nil {
+			t.Errorf("Missing forward record for %q", name)
+		}
+	}
+	if z.Zones["example.com"].Records["ignored.example.com."] != nil {
+		t.Errorf("name_template_override should have replaced dns_name")
+	}
+}
+
+func TestNameTemplateInvalid(t *testing.T) {
+	cfg := &Config{}
+	cfg.Defaults.NameTemplate = "{{.Device"
+
+	_, err := NewZonesFromConfig(cfg)
+	if err == nil {
+		t.Errorf("NewZonesFromConfig() with an invalid template should have failed")
+	}
+}
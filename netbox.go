@@ -1,16 +1,388 @@
 package netbox2dns
 
 import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+
 	httptransport "github.com/go-openapi/runtime/client"
+	log "github.com/golang/glog"
 	"github.com/netbox-community/go-netbox/v3/netbox/client"
+	"github.com/netbox-community/go-netbox/v3/netbox/client/dcim"
+	"github.com/netbox-community/go-netbox/v3/netbox/client/ipam"
+	"github.com/netbox-community/go-netbox/v3/netbox/client/virtualization"
+	"github.com/netbox-community/go-netbox/v3/netbox/models"
 	"github.com/scottlaird/netboxlib/netbox"
 )
 
-// GetNetboxIPAddresses fetches a list of IP Addresses from a Netbox server.
-func GetNetboxIPAddresses(host, token string) (netbox.IPAddrs, error) {
+// newNetboxClient creates a new Netbox API client.
+func newNetboxClient(host, token string) *client.NetBoxAPI {
 	transport := httptransport.New(host, client.DefaultBasePath, []string{"https"})
 	transport.DefaultAuthentication = httptransport.APIKeyAuth("Authorization", "header", "Token "+token)
-	c := client.New(transport, nil)
+	return client.New(transport, nil)
+}
+
+// IPAddr is a Netbox IP address, reduced to the fields that
+// netbox2dns uses.
+type IPAddr struct {
+	ID                 int64
+	Address            netip.Prefix
+	AssignedObjectID   int64
+	AssignedObjectType string
+	DNSName            string
+	Role               string
+	Status             string
+	Tags               map[string]bool // Tag slug -> true
+	Tenant             string          // Tenant slug
+	VRF                string          // VRF name; empty for the global table
+}
+
+// IPAddrs is a list of IP addresses.
+type IPAddrs []*IPAddr
+
+// netboxPageSize is the number of objects requested from Netbox at a
+// time.  Netbox caps this at its MAX_PAGE_SIZE setting, which is 1000
+// by default.
+const netboxPageSize = 1000
+
+// netboxRetries is the number of times that a failed page is retried,
+// and netboxRetryDelay is the delay before the first retry.  The delay
+// doubles after each failure.
+var (
+	netboxRetries    = 3
+	netboxRetryDelay = 2 * time.Second
+)
+
+// GetNetboxIPAddresses fetches a list of IP Addresses from a Netbox
+// server.  If filter is not nil, then as much of it as possible is
+// passed to Netbox, so that only matching addresses are downloaded.
+// Callers still need to check each address with filter.Match.
+//
+// Addresses are fetched a page at a time, and failed pages are
+// retried.  If the number of addresses fetched doesn't match the
+// count reported by Netbox, then an error is returned rather than a
+// partial list.  Retries stop once ctx is done.
+func GetNetboxIPAddresses(ctx context.Context, host, token string, filter *Filter) (IPAddrs, error) {
+	return getIPAddresses(ctx, newNetboxClient(host, token), filter)
+}
+
+func getIPAddresses(ctx context.Context, c *client.NetBoxAPI, filter *Filter) (IPAddrs, error) {
+	results, err := getAllPages(ctx, "IP addresses", func(offset, limit int64) (*int64, []*models.IPAddress, error) {
+		p := ipam.NewIpamIPAddressesListParamsWithContext(ctx)
+		p.Limit = &limit
+		p.Offset = &offset
+		filter.QueryParams(p)
+
+		rs, err := c.Ipam.IpamIPAddressesList(p, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return rs.Payload.Count, rs.Payload.Results, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := IPAddrs{}
+	for _, i := range results {
+		addr, err := ipAddrFromModel(i)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// getAllPages fetches every object from a Netbox list API, a page at
+// a time.  list fetches a single page and returns Netbox's count of
+// objects along with the page's results.  Failed pages are retried,
+// and if the number of objects fetched doesn't match the count
+// reported by Netbox, then an error is returned rather than a partial
+// list.  what describes the objects for error messages.
+func getAllPages[T any](ctx context.Context, what string, list func(offset, limit int64) (*int64, []T, error)) ([]T, error) {
+	all := []T{}
+	count := int64(-1)
+
+	for offset := int64(0); count < 0 || offset < count; {
+		pageCount, results, err := getPage(ctx, what, list, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		if count < 0 {
+			count = pageCount
+		} else if pageCount != count {
+			return nil, fmt.Errorf("Netbox %s count changed from %d to %d while fetching; try again", what, count, pageCount)
+		}
+		if len(results) == 0 {
+			break
+		}
+
+		all = append(all, results...)
+		offset += int64(len(results))
+	}
+
+	if int64(len(all)) != count {
+		return nil, fmt.Errorf("Fetched %d %s from Netbox, but Netbox reported %d", len(all), what, count)
+	}
+	return all, nil
+}
+
+// getPage fetches a single page of objects, retrying on failure.
+func getPage[T any](ctx context.Context, what string, list func(offset, limit int64) (*int64, []T, error), offset int64) (int64, []T, error) {
+	delay := netboxRetryDelay
+
+	for attempt := 0; ; attempt++ {
+		count, results, err := list(offset, netboxPageSize)
+		if err == nil {
+			if count == nil {
+				return 0, nil, fmt.Errorf("Netbox didn't return a count of %s", what)
+			}
+			return *count, results, nil
+		}
+		if attempt >= netboxRetries || ctx.Err() != nil {
+			return 0, nil, fmt.Errorf("Unable to list %s at offset %d after %d attempts: %v", what, offset, attempt+1, err)
+		}
+		log.Warningf("Unable to list %s at offset %d, retrying in %v: %v", what, offset, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		delay *= 2
+	}
+}
+
+// ipAddrFromModel converts a go-netbox IPAddress into an IPAddr.
+func ipAddrFromModel(i *models.IPAddress) (*IPAddr, error) {
+	addr := &IPAddr{
+		ID:                 i.ID,
+		AssignedObjectID:   netbox.Int64(i.AssignedObjectID),
+		AssignedObjectType: netbox.String(i.AssignedObjectType),
+		DNSName:            i.DNSName,
+		Tags:               make(map[string]bool),
+	}
+
+	prefix, err := netip.ParsePrefix(netbox.String(i.Address))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse address of IP address %d: %v", i.ID, err)
+	}
+	addr.Address = prefix
+
+	if i.Role != nil {
+		addr.Role = netbox.String(i.Role.Value)
+	}
+	if i.Status != nil {
+		addr.Status = netbox.String(i.Status.Value)
+	}
+	if i.Tenant != nil {
+		addr.Tenant = netbox.String(i.Tenant.Slug)
+	}
+	if i.Vrf != nil {
+		addr.VRF = netbox.String(i.Vrf.Name)
+	}
+	for _, t := range i.Tags {
+		addr.Tags[netbox.String(t.Slug)] = true
+	}
+	return addr, nil
+}
+
+// Host is a Netbox device or virtual machine, reduced to the fields
+// that netbox2dns uses for naming.
+type Host struct {
+	ID         int64
+	Name       string
+	IsVM       bool
+	Site       string // Site slug
+	Cluster    string // Cluster name; only set for VMs
+	Tenant     string // Tenant slug
+	Role       string // Device role or VM role slug
+	PrimaryIP4 netip.Addr
+	PrimaryIP6 netip.Addr
+}
+
+// Interface is a Netbox device interface or VM interface.
+type Interface struct {
+	ID   int64
+	Name string
+	Host *Host
+}
+
+// Hosts contains all of the devices, virtual machines, and interfaces
+// known to Netbox, indexed by ID.  It's used for finding the object
+// that an IP address is assigned to.
+type Hosts struct {
+	Devices      map[int64]*Host
+	VMs          map[int64]*Host
+	Interfaces   map[int64]*Interface // dcim.interface
+	VMInterfaces map[int64]*Interface // virtualization.vminterface
+}
+
+// NewHosts creates a new, empty, Hosts.
+func NewHosts() *Hosts {
+	return &Hosts{
+		Devices:      make(map[int64]*Host),
+		VMs:          make(map[int64]*Host),
+		Interfaces:   make(map[int64]*Interface),
+		VMInterfaces: make(map[int64]*Interface),
+	}
+}
+
+// InterfaceFor returns the interface that an IP address is assigned
+// to, or nil if it isn't assigned to a known interface.
+func (h *Hosts) InterfaceFor(addr *IPAddr) *Interface {
+	if h == nil {
+		return nil
+	}
+	switch addr.AssignedObjectType {
+	case "dcim.interface":
+		return h.Interfaces[addr.AssignedObjectID]
+	case "virtualization.vminterface":
+		return h.VMInterfaces[addr.AssignedObjectID]
+	}
+	return nil
+}
+
+// GetNetboxHosts fetches all devices, virtual machines, and their
+// interfaces from a Netbox server.  Each list is fetched a page at a
+// time, with the same retries and count checks as
+// GetNetboxIPAddresses.
+func GetNetboxHosts(ctx context.Context, host, token string) (*Hosts, error) {
+	return getHosts(ctx, newNetboxClient(host, token))
+}
+
+func getHosts(ctx context.Context, c *client.NetBoxAPI) (*Hosts, error) {
+	hosts := NewHosts()
+
+	devices, err := getAllPages(ctx, "devices", func(offset, limit int64) (*int64, []*models.DeviceWithConfigContext, error) {
+		p := dcim.NewDcimDevicesListParamsWithContext(ctx)
+		p.Limit = &limit
+		p.Offset = &offset
+		rs, err := c.Dcim.DcimDevicesList(p, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return rs.Payload.Count, rs.Payload.Results, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range devices {
+		h := &Host{
+			ID:         d.ID,
+			Name:       netbox.String(d.Name),
+			PrimaryIP4: nestedAddr(d.PrimaryIp4),
+			PrimaryIP6: nestedAddr(d.PrimaryIp6),
+		}
+		if d.Site != nil {
+			h.Site = netbox.String(d.Site.Slug)
+		}
+		if d.Tenant != nil {
+			h.Tenant = netbox.String(d.Tenant.Slug)
+		}
+		if d.DeviceRole != nil {
+			h.Role = netbox.String(d.DeviceRole.Slug)
+		}
+		hosts.Devices[h.ID] = h
+	}
+
+	vms, err := getAllPages(ctx, "virtual machines", func(offset, limit int64) (*int64, []*models.VirtualMachineWithConfigContext, error) {
+		p := virtualization.NewVirtualizationVirtualMachinesListParamsWithContext(ctx)
+		p.Limit = &limit
+		p.Offset = &offset
+		rs, err := c.Virtualization.VirtualizationVirtualMachinesList(p, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return rs.Payload.Count, rs.Payload.Results, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vms {
+		h := &Host{
+			ID:         v.ID,
+			Name:       netbox.String(v.Name),
+			IsVM:       true,
+			PrimaryIP4: nestedAddr(v.PrimaryIp4),
+			PrimaryIP6: nestedAddr(v.PrimaryIp6),
+		}
+		if v.Site != nil {
+			h.Site = netbox.String(v.Site.Slug)
+		}
+		if v.Cluster != nil {
+			h.Cluster = netbox.String(v.Cluster.Name)
+		}
+		if v.Tenant != nil {
+			h.Tenant = netbox.String(v.Tenant.Slug)
+		}
+		if v.Role != nil {
+			h.Role = netbox.String(v.Role.Slug)
+		}
+		hosts.VMs[h.ID] = h
+	}
+
+	ifs, err := getAllPages(ctx, "interfaces", func(offset, limit int64) (*int64, []*models.Interface, error) {
+		p := dcim.NewDcimInterfacesListParamsWithContext(ctx)
+		p.Limit = &limit
+		p.Offset = &offset
+		rs, err := c.Dcim.DcimInterfacesList(p, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return rs.Payload.Count, rs.Payload.Results, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range ifs {
+		in := &Interface{
+			ID:   i.ID,
+			Name: netbox.String(i.Name),
+		}
+		if i.Device != nil {
+			in.Host = hosts.Devices[i.Device.ID]
+		}
+		hosts.Interfaces[in.ID] = in
+	}
+
+	vifs, err := getAllPages(ctx, "VM interfaces", func(offset, limit int64) (*int64, []*models.VMInterface, error) {
+		p := virtualization.NewVirtualizationInterfacesListParamsWithContext(ctx)
+		p.Limit = &limit
+		p.Offset = &offset
+		rs, err := c.Virtualization.VirtualizationInterfacesList(p, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		return rs.Payload.Count, rs.Payload.Results, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range vifs {
+		in := &Interface{
+			ID:   i.ID,
+			Name: netbox.String(i.Name),
+		}
+		if i.VirtualMachine != nil {
+			in.Host = hosts.VMs[i.VirtualMachine.ID]
+		}
+		hosts.VMInterfaces[in.ID] = in
+	}
+
+	return hosts, nil
+}
 
-	return netbox.ListIPAddrs(c)
+// nestedAddr returns the address from a NestedIPAddress, or an
+// invalid netip.Addr if there isn't one.
+func nestedAddr(n *models.NestedIPAddress) netip.Addr {
+	if n == nil {
+		return netip.Addr{}
+	}
+	prefix, err := netip.ParsePrefix(netbox.String(n.Address))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return prefix.Addr()
 }
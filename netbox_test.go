@@ -0,0 +1,169 @@
+package netbox2dns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	httptransport "github.com/go-openapi/runtime/client"
+	"github.com/netbox-community/go-netbox/v3/netbox/client"
+)
+
+// testNetbox serves a fake Netbox IP address list.  It returns two
+// addresses per page, reports `count` as the total, and fails the
+// first `failures` requests.
+func testNetbox(t *testing.T, addrs []string, count int, failures int) *client.NetBoxAPI {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/ipam/ip-addresses/" {
+			http.NotFound(w, r)
+			return
+		}
+		if failures > 0 {
+			failures--
+			http.Error(w, "try again", http.StatusBadGateway)
+			return
+		}
+
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		results := []map[string]any{}
+		for i := offset; i < len(addrs) && i < offset+2; i++ {
+			results = append(results, map[string]any{
+				"id":      i + 1,
+				"address": addrs[i],
+				"status":  map[string]string{"value": "active", "label": "Active"},
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"count":   count,
+			"results": results,
+		})
+	}))
+	t.Cleanup(ts.Close)
+
+	u, _ := url.Parse(ts.URL)
+	return client.New(httptransport.New(u.Host, client.DefaultBasePath, []string{"http"}), nil)
+}
+
+func TestGetIPAddresses(t *testing.T) {
+	oldNetboxRetryDelay := netboxRetryDelay
+	t.Cleanup(func() { netboxRetryDelay = oldNetboxRetryDelay })
+	netboxRetryDelay = 0
+	addrs := []string{"10.0.0.1/24", "10.0.0.2/24", "10.0.0.3/24", "10.0.0.4/24", "10.0.0.5/24"}
+
+	tests := []struct {
+		name     string
+		count    int
+		failures int
+		wantErr  bool
+	}{
+		{"ok", 5, 0, false},
+		{"retry", 5, 2, false},
+		{"too-many-failures", 5, netboxRetries + 1, true},
+		{"truncated", 7, 0, true},
+	}
+
+	for _, test := range tests {
+		c := testNetbox(t, addrs, test.count, test.failures)
+		got, err := getIPAddresses(context.Background(), c, DefaultFilter())
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("getIPAddresses(%s) succeeded, want error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("getIPAddresses(%s) returned error: %v", test.name, err)
+		}
+		if len(got) != len(addrs) {
+			t.Fatalf("getIPAddresses(%s): got %d addresses, want %d", test.name, len(got), len(addrs))
+		}
+		for i, a := range got {
+			if a.Address.String() != addrs[i] || a.Status != "active" {
+				t.Errorf("getIPAddresses(%s)[%d]: got %s %q, want %s active", test.name, i, a.Address, a.Status, addrs[i])
+			}
+		}
+	}
+}
+
+// testNetboxLists serves fake Netbox lists, keyed by API path.  Like
+// testNetbox, it returns two objects per page, and fails the first
+// `failures` requests.
+func testNetboxLists(t *testing.T, lists map[string][]map[string]any, failures int) *client.NetBoxAPI {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list, ok := lists[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if failures > 0 {
+			failures--
+			http.Error(w, "try again", http.StatusBadGateway)
+			return
+		}
+
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		results := []map[string]any{}
+		for i := offset; i < len(list) && i < offset+2; i++ {
+			results = append(results, list[i])
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"count":   len(list),
+			"results": results,
+		})
+	}))
+	t.Cleanup(ts.Close)
+
+	u, _ := url.Parse(ts.URL)
+	return client.New(httptransport.New(u.Host, client.DefaultBasePath, []string{"http"}), nil)
+}
+
+func TestGetHosts(t *testing.T) {
+	oldNetboxRetryDelay := netboxRetryDelay
+	t.Cleanup(func() { netboxRetryDelay = oldNetboxRetryDelay })
+	netboxRetryDelay = 0
+
+	// More of each than fit on one page.
+	lists := map[string][]map[string]any{}
+	for i := 1; i <= 5; i++ {
+		lists["/api/dcim/devices/"] = append(lists["/api/dcim/devices/"], map[string]any{
+			"id": i, "name": fmt.Sprintf("router%d", i), "site": map[string]any{"slug": "sea1"},
+		})
+		lists["/api/virtualization/virtual-machines/"] = append(lists["/api/virtualization/virtual-machines/"], map[string]any{
+			"id": i, "name": fmt.Sprintf("web%d", i),
+		})
+		lists["/api/dcim/interfaces/"] = append(lists["/api/dcim/interfaces/"], map[string]any{
+			"id": 10 + i, "name": "eth0", "device": map[string]any{"id": i},
+		})
+		lists["/api/virtualization/interfaces/"] = append(lists["/api/virtualization/interfaces/"], map[string]any{
+			"id": 20 + i, "name": "eth0", "virtual_machine": map[string]any{"id": i},
+		})
+	}
+
+	hosts, err := getHosts(context.Background(), testNetboxLists(t, lists, 2))
+	if err != nil {
+		t.Fatalf("getHosts() returned error: %v", err)
+	}
+	if len(hosts.Devices) != 5 || len(hosts.VMs) != 5 || len(hosts.Interfaces) != 5 || len(hosts.VMInterfaces) != 5 {
+		t.Fatalf("getHosts() returned %d devices, %d VMs, %d interfaces, and %d VM interfaces, want 5 of each", len(hosts.Devices), len(hosts.VMs), len(hosts.Interfaces), len(hosts.VMInterfaces))
+	}
+	if h := hosts.Interfaces[15].Host; h == nil || h.Name != "router5" || h.Site != "sea1" {
+		t.Errorf("getHosts(): interface 15 has host %+v, want router5 in sea1", h)
+	}
+	if h := hosts.VMInterfaces[25].Host; h == nil || h.Name != "web5" {
+		t.Errorf("getHosts(): VM interface 25 has host %+v, want web5", h)
+	}
+
+	_, err = getHosts(context.Background(), testNetboxLists(t, lists, netboxRetries+1))
+	if err == nil {
+		t.Errorf("getHosts() succeeded after too many failures, want error")
+	}
+}
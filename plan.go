@@ -0,0 +1,158 @@
+package netbox2dns
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// planVersion is the current version of the plan file format.
+const planVersion = 1
+
+// Plan is a saved Diff, written by `netbox2dns plan` and applied later
+// by `netbox2dns apply`.  It includes a fingerprint of each zone that
+// the plan changes, taken when the plan was made, so that apply can
+// refuse to run if the zone has changed since then.
+type Plan struct {
+	Version      int               `json:"version"`
+	Created      time.Time         `json:"created"`
+	Fingerprints map[string]string `json:"fingerprints"` // Zone key -> Fingerprint()
+	Diff         *Diff             `json:"diff"`
+}
+
+// NewPlan creates a Plan from a Diff and the imported zones that the
+// Diff was computed from.
+func NewPlan(d *Diff, imported *Zones) *Plan {
+	p := &Plan{
+		Version:      planVersion,
+		Created:      time.Now().UTC(),
+		Fingerprints: make(map[string]string),
+		Diff:         d,
+	}
+	for _, c := range d.Changes {
+		if _, ok := p.Fingerprints[c.Key()]; !ok {
+			p.Fingerprints[c.Key()] = imported.Zones[c.Key()].Fingerprint()
+		}
+	}
+	return p
+}
+
+// LoadPlan reads a Plan from a file.
+func LoadPlan(filename string) (*Plan, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read plan %q: %v", filename, err)
+	}
+
+	p := &Plan{}
+	err = json.Unmarshal(b, p)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse plan %q: %v", filename, err)
+	}
+	if p.Version != planVersion {
+		return nil, fmt.Errorf("Plan %q has version %d, want %d", filename, p.Version, planVersion)
+	}
+	if p.Diff == nil {
+		return nil, fmt.Errorf("Plan %q has no changes", filename)
+	}
+	return p, nil
+}
+
+// Save writes a Plan to a file.
+func (p *Plan) Save(filename string) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(filename, append(b, '\n'))
+	if err != nil {
+		return fmt.Errorf("Unable to write plan %q: %v", filename, err)
+	}
+	return nil
+}
+
+// Check returns an error if any zone that the plan changes is missing
+// from imported, or has changed since the plan was made.
+func (p *Plan) Check(imported *Zones) error {
+	keys := make([]string, 0, len(p.Fingerprints))
+	for k := range p.Fingerprints {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		zone := imported.Zones[k]
+		if zone == nil {
+			return fmt.Errorf("Zone %q from the plan isn't in the config", k)
+		}
+		if zone.Fingerprint() != p.Fingerprints[k] {
+			return fmt.Errorf("Zone %q has changed since the plan was made", k)
+		}
+	}
+	for _, c := range p.Diff.Changes {
+		if _, ok := p.Fingerprints[c.Key()]; !ok {
+			return fmt.Errorf("Plan has changes for zone %q, but no fingerprint", c.Key())
+		}
+	}
+	return nil
+}
+
+// without returns a copy of the plan with no changes or fingerprints
+// for the given zones.
+func (p *Plan) without(zones ZoneErrors) *Plan {
+	if len(zones) == 0 {
+		return p
+	}
+	np := *p
+	np.Fingerprints = make(map[string]string)
+	for k, v := range p.Fingerprints {
+		if _, ok := zones[k]; !ok {
+			np.Fingerprints[k] = v
+		}
+	}
+	np.Diff = &Diff{Changes: []*Change{}}
+	for _, c := range p.Diff.Changes {
+		if _, ok := zones[c.Key()]; ok {
+			continue
+		}
+		np.Diff.Changes = append(np.Diff.Changes, c)
+		if c.Action == ActionRemove {
+			np.Diff.Removals++
+		} else {
+			np.Diff.Additions++
+		}
+	}
+	return &np
+}
+
+// Fingerprint returns a hash of every record in the zone.  It doesn't
+// depend on the order that records were added in, so two imports of
+// an unchanged zone have the same fingerprint.  A nil zone has an
+// empty fingerprint.
+func (z *Zone) Fingerprint() string {
+	if z == nil {
+		return ""
+	}
+
+	lines := []string{}
+	for _, records := range z.Records {
+		for _, r := range records {
+			rrdatas := append([]string{}, r.Rrdatas...)
+			sort.Strings(rrdatas)
+			lines = append(lines, fmt.Sprintf("%s %s %d %s", strings.ToLower(r.Name), r.Type, r.TTL, strings.Join(rrdatas, " ")))
+		}
+	}
+	sort.Strings(lines)
+
+	h := sha256.New()
+	for _, l := range lines {
+		h.Write([]byte(l))
+		h.Write([]byte{'\n'})
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
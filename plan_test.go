@@ -0,0 +1,78 @@
+package netbox2dns
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func testImportedZones() *Zones {
+	z := NewZones()
+	z.NewZone(&ConfigZone{Name: "example.com", TTL: 300})
+	z.NewZone(&ConfigZone{Name: "10.in-addr.arpa", TTL: 300, View: "lab"})
+	z.Zones["example.com"].AddRecord(&Record{Name: "c.example.com.", Type: "A", Rrdatas: []string{"10.0.0.3"}})
+	z.Zones["example.com"].AddRecord(&Record{Name: "c.example.com.", Type: "MX", Rrdatas: []string{"10 mail.example.com."}})
+	return z
+}
+
+func TestFingerprint(t *testing.T) {
+	a := &Zone{Name: "example.com", Records: make(map[string][]*Record)}
+	a.AddRecord(&Record{Name: "a.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.1", "10.0.0.2"}})
+	a.AddRecord(&Record{Name: "a.example.com.", Type: "AAAA", TTL: 300, Rrdatas: []string{"2001:db8::1"}})
+
+	b := &Zone{Name: "example.com", Records: make(map[string][]*Record)}
+	b.AddRecord(&Record{Name: "A.example.com.", Type: "AAAA", TTL: 300, Rrdatas: []string{"2001:db8::1"}})
+	b.AddRecord(&Record{Name: "a.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.2", "10.0.0.1"}})
+
+	if a.Fingerprint() != b.Fingerprint() {
+		t.Errorf("Fingerprint() depends on record order: %q != %q", a.Fingerprint(), b.Fingerprint())
+	}
+
+	b.AddRecord(&Record{Name: "b.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.3"}})
+	if a.Fingerprint() == b.Fingerprint() {
+		t.Errorf("Fingerprint() didn't change when a record was added")
+	}
+}
+
+func TestPlan(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "plan.json")
+
+	zones := testImportedZones()
+	p := NewPlan(testDiff(), zones)
+	if len(p.Fingerprints) != 2 {
+		t.Fatalf("NewPlan() got %d fingerprints, want 2: %v", len(p.Fingerprints), p.Fingerprints)
+	}
+
+	err := p.Save(filename)
+	if err != nil {
+		t.Fatalf("Save() returned error: %v", err)
+	}
+	loaded, err := LoadPlan(filename)
+	if err != nil {
+		t.Fatalf("LoadPlan() returned error: %v", err)
+	}
+	if len(loaded.Diff.Changes) != 4 || loaded.Diff.Changes[0].Action != ActionRemove {
+		t.Errorf("LoadPlan() changes wrong; got %+v", loaded.Diff.Changes)
+	}
+
+	// A fresh import of the same zones passes.
+	err = loaded.Check(testImportedZones())
+	if err != nil {
+		t.Errorf("Check() of unchanged zones returned error: %v", err)
+	}
+
+	// A zone changed by someone else fails.
+	changed := testImportedZones()
+	changed.Zones["lab/10.in-addr.arpa"].AddRecord(&Record{Name: "9.0.0.10.in-addr.arpa.", Type: "PTR", Rrdatas: []string{"x.example.com."}})
+	err = loaded.Check(changed)
+	if err == nil {
+		t.Errorf("Check() of a changed zone succeeded, want error")
+	}
+
+	// A zone that's no longer in the config fails.
+	missing := testImportedZones()
+	delete(missing.Zones, "example.com")
+	err = loaded.Check(missing)
+	if err == nil {
+		t.Errorf("Check() of a missing zone succeeded, want error")
+	}
+}
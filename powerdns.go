@@ -0,0 +1,312 @@
+package netbox2dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+)
+
+// PowerDNS implements talking to the PowerDNS Authoritative Server
+// HTTP API, and provides methods for fetching existing DNS entries,
+// adding new entries, or deleting old entries.
+//
+// PowerDNS treats each name+type as a single rrset, so additions and
+// removals are applied to a local copy of the zone's rrsets, and
+// Save() sends every changed rrset to PowerDNS in a single PATCH
+// request.
+type PowerDNS struct {
+	apiURL string
+	apiKey string
+	server string
+	client *http.Client
+	rrsets map[powerDNSKey]*powerDNSRRSet
+	dirty  map[powerDNSKey]bool
+	api    *apiCaller
+}
+
+// powerDNSKey identifies a single rrset.  Names are compared in
+// canonical form, since PowerDNS and Netbox may not agree on case.
+type powerDNSKey struct {
+	name  string
+	rtype string
+}
+
+func newPowerDNSKey(name, rtype string) powerDNSKey {
+	return powerDNSKey{canonicalName(name), rtype}
+}
+
+// powerDNSZone matches the zone object returned by the PowerDNS API.
+type powerDNSZone struct {
+	Name   string           `json:"name,omitempty"`
+	RRSets []*powerDNSRRSet `json:"rrsets"`
+}
+
+// powerDNSRRSet matches the rrset object used by the PowerDNS API.
+type powerDNSRRSet struct {
+	Name       string            `json:"name"`
+	Type       string            `json:"type"`
+	TTL        int64             `json:"ttl,omitempty"`
+	ChangeType string            `json:"changetype,omitempty"`
+	Records    []*powerDNSRecord `json:"records"`
+}
+
+// powerDNSRecord matches the record object used by the PowerDNS API.
+type powerDNSRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+// NewPowerDNS creates a new PowerDNS.
+func NewPowerDNS(ctx context.Context, cz *ConfigZone) (*PowerDNS, error) {
+	if cz.APIURL == "" {
+		return nil, fmt.Errorf("No api_url specified for zone %q", cz.Name)
+	}
+
+	server := cz.ServerID
+	if server == "" {
+		server = "localhost"
+	}
+
+	return &PowerDNS{
+		apiURL: strings.TrimRight(cz.APIURL, "/"),
+		apiKey: cz.APIKey,
+		server: server,
+		client: http.DefaultClient,
+		rrsets: make(map[powerDNSKey]*powerDNSRRSet),
+		dirty:  make(map[powerDNSKey]bool),
+	}, nil
+}
+
+// zoneURL returns the API URL for a zone.
+func (pd *PowerDNS) zoneURL(cz *ConfigZone) string {
+	return fmt.Sprintf("%s/api/v1/servers/%s/zones/%s", pd.apiURL, url.PathEscape(pd.server), url.PathEscape(strings.TrimRight(cz.Name, ".")+"."))
+}
+
+// setAPICaller sets the apiCaller used to retry and rate limit calls
+// to PowerDNS.
+func (pd *PowerDNS) setAPICaller(a *apiCaller) {
+	pd.api = a
+}
+
+// do sends a request to the PowerDNS API and decodes the response
+// into `result`, if it's not nil.  Requests that fail with a transient
+// error are retried.
+func (pd *PowerDNS) do(ctx context.Context, method, u string, body, result interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		b, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	return pd.api.call(ctx, method+" "+u, func() error {
+		return pd.doOnce(ctx, method, u, b, result)
+	})
+}
+
+// doOnce sends a single request to the PowerDNS API.  Non-2xx
+// responses are returned as an *httpStatusError.
+func (pd *PowerDNS) doOnce(ctx context.Context, method, u string, body []byte, result interface{}) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", pd.apiKey)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := pd.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(resp.Body)
+		return &httpStatusError{
+			Code: resp.StatusCode,
+			Msg:  fmt.Sprintf("%s %s returned %s: %s", method, u, resp.Status, strings.TrimSpace(string(msg))),
+		}
+	}
+
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// ImportZone imports all entries from the specified PowerDNS zone.
+func (pd *PowerDNS) ImportZone(ctx context.Context, cz *ConfigZone) (*Zone, error) {
+	zone := &Zone{
+		Name:          cz.Name,
+		TTL:           cz.TTL,
+		DeleteEntries: cz.DeleteEntries,
+		IgnoreTTL:     cz.IgnoreTTL,
+		Records:       make(map[string][]*Record),
+	}
+
+	pz := &powerDNSZone{}
+	err := pd.do(ctx, "GET", pd.zoneURL(cz), nil, pz)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get zone: %v", err)
+	}
+
+	pd.rrsets = make(map[powerDNSKey]*powerDNSRRSet)
+	pd.dirty = make(map[powerDNSKey]bool)
+
+	for _, rrset := range pz.RRSets {
+		pd.rrsets[newPowerDNSKey(rrset.Name, rrset.Type)] = rrset
+
+		r := Record{
+			Name: rrset.Name,
+			Type: rrset.Type,
+			TTL:  rrset.TTL,
+		}
+		for _, rec := range rrset.Records {
+			if !rec.Disabled {
+				r.Rrdatas = append(r.Rrdatas, rec.Content)
+			}
+		}
+		if len(r.Rrdatas) > 0 {
+			zone.AddRecord(&r)
+		}
+	}
+
+	return zone, nil
+}
+
+// rrset returns the local copy of the rrset for a record, creating it
+// if needed, and marks it as changed.
+func (pd *PowerDNS) rrset(r *Record) *powerDNSRRSet {
+	key := newPowerDNSKey(r.Name, r.Type)
+	rrset := pd.rrsets[key]
+	if rrset == nil {
+		rrset = &powerDNSRRSet{
+			Name: r.Name,
+			Type: r.Type,
+			TTL:  r.TTL,
+		}
+		pd.rrsets[key] = rrset
+	}
+	pd.dirty[key] = true
+	return rrset
+}
+
+// WriteRecord adds a record to the local copy of the zone.  Note
+// that this won't actually be sent to PowerDNS until 'Save()' is
+// called.
+func (pd *PowerDNS) WriteRecord(ctx context.Context, cz *ConfigZone, r *Record) error {
+	rrset := pd.rrset(r)
+	rrset.TTL = r.TTL
+
+	for _, rrdata := range r.Rrdatas {
+		found := false
+		for _, rec := range rrset.Records {
+			if rec.Content == rrdata {
+				rec.Disabled = false
+				found = true
+			}
+		}
+		if !found {
+			rrset.Records = append(rrset.Records, &powerDNSRecord{Content: rrdata})
+		}
+	}
+	return nil
+}
+
+// RemoveRecord removes a record from the local copy of the zone.
+// Note that this won't actually be sent to PowerDNS until 'Save()' is
+// called.
+func (pd *PowerDNS) RemoveRecord(ctx context.Context, cz *ConfigZone, r *Record) error {
+	rrset := pd.rrset(r)
+
+	records := []*powerDNSRecord{}
+	for _, rec := range rrset.Records {
+		remove := false
+		for _, rrdata := range r.Rrdatas {
+			if rec.Content == rrdata {
+				remove = true
+			}
+		}
+		if !remove {
+			records = append(records, rec)
+		}
+	}
+	rrset.Records = records
+	return nil
+}
+
+// discardChanges drops all changes that haven't been saved.  The
+// local copies of changed rrsets are dropped too; they're fetched
+// again by the next ImportZone.
+func (pd *PowerDNS) discardChanges(cz *ConfigZone) {
+	for k := range pd.dirty {
+		delete(pd.rrsets, k)
+	}
+	pd.dirty = make(map[powerDNSKey]bool)
+}
+
+// Save sends all changed rrsets to PowerDNS in a single PATCH
+// request.  PowerDNS applies the whole request as one transaction.
+func (pd *PowerDNS) Save(ctx context.Context, cz *ConfigZone) error {
+	if len(pd.dirty) == 0 {
+		return nil
+	}
+
+	keys := make([]powerDNSKey, 0, len(pd.dirty))
+	for k := range pd.dirty {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name == keys[j].name {
+			return keys[i].rtype < keys[j].rtype
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	patch := &powerDNSZone{}
+	for _, k := range keys {
+		rrset := pd.rrsets[k]
+		change := &powerDNSRRSet{
+			Name:    rrset.Name,
+			Type:    rrset.Type,
+			TTL:     rrset.TTL,
+			Records: rrset.Records,
+		}
+		if len(rrset.Records) == 0 {
+			change.ChangeType = "DELETE"
+			change.TTL = 0
+			change.Records = []*powerDNSRecord{}
+			delete(pd.rrsets, k)
+		} else {
+			change.ChangeType = "REPLACE"
+		}
+		patch.RRSets = append(patch.RRSets, change)
+	}
+
+	log.Infof("Sending %d changed rrsets to PowerDNS for zone %q", len(patch.RRSets), cz.Name)
+	err := pd.do(ctx, "PATCH", pd.zoneURL(cz), patch, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to update zone %q: %v", cz.Name, err)
+	}
+
+	pd.dirty = make(map[powerDNSKey]bool)
+	return nil
+}
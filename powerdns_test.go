@@ -0,0 +1,172 @@
+package netbox2dns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// testPowerDNS serves zone from a fake PowerDNS API, and records the
+// PATCH requests that it receives.
+func testPowerDNS(t *testing.T, zone *powerDNSZone) (*httptest.Server, *[]*powerDNSZone) {
+	patches := &[]*powerDNSZone{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v1/servers/localhost/zones/example.com." {
+			t.Errorf("Unexpected request for %q", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			json.NewEncoder(w).Encode(zone)
+		case "PATCH":
+			p := &powerDNSZone{}
+			if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+				t.Errorf("Unable to decode PATCH: %v", err)
+			}
+			*patches = append(*patches, p)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("Unexpected method %q", r.Method)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts, patches
+}
+
+func TestPowerDNS(t *testing.T) {
+	zone := &powerDNSZone{
+		Name: "example.com.",
+		RRSets: []*powerDNSRRSet{
+			{Name: "example.com.", Type: "SOA", TTL: 3600, Records: []*powerDNSRecord{{Content: "ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300"}}},
+			{Name: "router1.example.com.", Type: "A", TTL: 300, Records: []*powerDNSRecord{{Content: "10.0.0.1"}, {Content: "10.0.0.2"}}},
+			{Name: "old.example.com.", Type: "A", TTL: 300, Records: []*powerDNSRecord{{Content: "10.0.0.3"}}},
+		},
+	}
+	ts, patches := testPowerDNS(t, zone)
+
+	cz := &ConfigZone{
+		ZoneType: "powerdns",
+		Name:     "example.com",
+		APIURL:   ts.URL + "/",
+		APIKey:   "secret",
+		TTL:      300,
+	}
+
+	p, err := NewDNSProvider(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("NewDNSProvider() returned error: %v", err)
+	}
+
+	z, err := p.ImportZone(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("ImportZone() returned error: %v", err)
+	}
+	r := z.Records["router1.example.com."]
+	if len(r) != 1 || len(r[0].Rrdatas) != 2 {
+		t.Errorf("ImportZone(): got %+v for router1.example.com., want 1 record with 2 rrdatas", r)
+	}
+
+	p.RemoveRecord(context.Background(), cz, &Record{Name: "router1.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.2"}})
+	p.RemoveRecord(context.Background(), cz, &Record{Name: "old.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.3"}})
+	p.WriteRecord(context.Background(), cz, &Record{Name: "new.example.com.", Type: "AAAA", TTL: 300, Rrdatas: []string{"2001:db8::1"}})
+
+	if len(*patches) != 0 {
+		t.Fatalf("Changes sent before Save(): got %d, want 0", len(*patches))
+	}
+	err = p.Save(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("Save() returned error: %v", err)
+	}
+	if len(*patches) != 1 {
+		t.Fatalf("Save() sent %d PATCH requests, want 1", len(*patches))
+	}
+
+	got := make(map[string]*powerDNSRRSet)
+	for _, rrset := range (*patches)[0].RRSets {
+		got[rrset.Name] = rrset
+	}
+	if len(got) != 3 {
+		t.Errorf("Save() sent %d rrsets, want 3", len(got))
+	}
+	if rrset := got["router1.example.com."]; rrset == nil || rrset.ChangeType != "REPLACE" || len(rrset.Records) != 1 || rrset.Records[0].Content != "10.0.0.1" {
+		t.Errorf("Wrong change for router1.example.com.: %+v", rrset)
+	}
+	if rrset := got["old.example.com."]; rrset == nil || rrset.ChangeType != "DELETE" {
+		t.Errorf("Wrong change for old.example.com.: %+v", rrset)
+	}
+	if rrset := got["new.example.com."]; rrset == nil || rrset.ChangeType != "REPLACE" || len(rrset.Records) != 1 || rrset.Records[0].Content != "2001:db8::1" {
+		t.Errorf("Wrong change for new.example.com.: %+v", rrset)
+	}
+}
+
+func TestPowerDNSMixedCase(t *testing.T) {
+	zone := &powerDNSZone{
+		Name: "example.com.",
+		RRSets: []*powerDNSRRSet{
+			{Name: "Multi.Example.com.", Type: "A", TTL: 300, Records: []*powerDNSRecord{{Content: "10.0.0.1"}}},
+		},
+	}
+	ts, patches := testPowerDNS(t, zone)
+
+	cz := &ConfigZone{
+		ZoneType: "powerdns",
+		Name:     "example.com",
+		APIURL:   ts.URL + "/",
+		APIKey:   "secret",
+		TTL:      300,
+	}
+	p, err := NewDNSProvider(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("NewDNSProvider() returned error: %v", err)
+	}
+	imported, err := p.ImportZone(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("ImportZone() returned error: %v", err)
+	}
+
+	// Netbox spells the name differently, and has a second address.
+	z := NewZones()
+	z.NewZone(cz)
+	err = z.AddAddrs(IPAddrs{
+		{Address: netip.MustParsePrefix("10.0.0.1/24"), Status: "active", DNSName: "MULTI.example.com"},
+		{Address: netip.MustParsePrefix("10.0.0.2/24"), Status: "active", DNSName: "MULTI.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("AddAddrs() returned error: %v", err)
+	}
+
+	zd := imported.NewZoneDelta()
+	imported.Compare(z.Zones["example.com"], zd)
+	added := zd.AddRecords["multi.example.com."]
+	if len(zd.RemoveRecords) != 0 || len(zd.AddRecords) != 1 || len(added) != 1 || added[0].Name != "multi.example.com." || fmt.Sprint(added[0].Rrdatas) != "[10.0.0.2]" {
+		t.Fatalf("Compare(): got add %v, remove %v, want only 10.0.0.2 added to multi.example.com.", zd.AddRecords, zd.RemoveRecords)
+	}
+
+	err = p.WriteRecord(context.Background(), cz, added[0])
+	if err != nil {
+		t.Fatalf("WriteRecord() returned error: %v", err)
+	}
+	err = p.Save(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("Save() returned error: %v", err)
+	}
+
+	// The existing rrset is updated, rather than replaced by one
+	// with only the new address.
+	if len(*patches) != 1 || len((*patches)[0].RRSets) != 1 {
+		t.Fatalf("Save() sent %v, want 1 rrset", *patches)
+	}
+	rrset := (*patches)[0].RRSets[0]
+	if rrset.ChangeType != "REPLACE" || len(rrset.Records) != 2 || rrset.Records[0].Content != "10.0.0.1" || rrset.Records[1].Content != "10.0.0.2" {
+		t.Errorf("Wrong change for multi.example.com.: %+v", rrset)
+	}
+}
@@ -1,10 +1,37 @@
 package netbox2dns
 
 import (
+	"fmt"
+	"net/netip"
+	"slices"
 	"strings"
+
+	"github.com/miekg/dns"
 )
 
-// Record describes a DNS record, like 'foo.example.com IN AAAA 1:2::3:4'.
+// Managed decides which records netbox2dns is allowed to remove: ones
+// of the record types that it creates, plus its own TXT registry
+// records if ownership tracking is enabled.  All other records (SOA,
+// NS, MX, etc) are left alone.  See Config.Managed.
+type Managed struct {
+	Types    map[string]bool
+	Registry *Registry // Nil unless ownership tracking is enabled
+}
+
+// DefaultManaged returns a Managed for the record types that
+// netbox2dns always creates: A, AAAA, and PTR.
+func DefaultManaged() *Managed {
+	return &Managed{Types: map[string]bool{
+		"A":    true,
+		"AAAA": true,
+		"PTR":  true,
+	}}
+}
+
+// Record describes a DNS rrset: all of the records with the same name
+// and type, like 'foo.example.com IN AAAA 1:2::3:4' and 'foo.example.com
+// IN AAAA 1:2::3:5'.  Records in a Zone are canonical; see
+// Zone.AddRecord.
 type Record struct {
 	Name    string
 	Type    string
@@ -21,3 +48,123 @@ func (r *Record) NameNoDot() string {
 func (r *Record) RrdataNoDot() string {
 	return strings.TrimRight(r.Rrdatas[0], ".")
 }
+
+// canonicalName returns a DNS name in the form used to compare names:
+// lower case, with a trailing dot.
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+// canonicalRrdata returns an rrdata in the form used to compare
+// rrdatas.  Addresses are parsed, so `2001:DB8:0::1` and `2001:db8::1`
+// are the same, and names in PTR and CNAME records are compared like
+// record names.  Other types are compared as-is.
+func canonicalRrdata(rtype, rrdata string) string {
+	switch rtype {
+	case "A", "AAAA":
+		if a, err := netip.ParseAddr(rrdata); err == nil {
+			return a.String()
+		}
+	case "PTR", "CNAME":
+		return canonicalName(rrdata)
+	}
+	return rrdata
+}
+
+// Equal returns true if r and other are the same rrset: they have the
+// same name and type, and the same rrdatas in any order.  Names and
+// rrdatas are compared in canonical form; see canonicalName and
+// canonicalRrdata.  TTLs must match too, unless ignoreTTL is set.
+func (r *Record) Equal(other *Record, ignoreTTL bool) bool {
+	if canonicalName(r.Name) != canonicalName(other.Name) || r.Type != other.Type {
+		return false
+	}
+	if !ignoreTTL && r.TTL != other.TTL {
+		return false
+	}
+	return r.without(other) == nil && other.without(r) == nil
+}
+
+// without returns a copy of r holding just the rrdatas that aren't in
+// other, or nil if there aren't any.
+func (r *Record) without(other *Record) *Record {
+	have := make(map[string]bool, len(other.Rrdatas))
+	for _, rrdata := range other.Rrdatas {
+		have[canonicalRrdata(other.Type, rrdata)] = true
+	}
+
+	var rrdatas []string
+	for _, rrdata := range r.Rrdatas {
+		if !have[canonicalRrdata(r.Type, rrdata)] {
+			rrdatas = append(rrdatas, rrdata)
+		}
+	}
+	if len(rrdatas) == 0 {
+		return nil
+	}
+	return &Record{Name: r.Name, Type: r.Type, TTL: r.TTL, Rrdatas: rrdatas}
+}
+
+// normalize sorts a record's Rrdatas and removes duplicates, so that
+// two copies of the same rrset always look the same.  Rrdatas are
+// sorted and compared in canonical form, but keep their original
+// text, so records read from a provider can be removed from it
+// again.  Rrdatas is copied first, so slices shared with other
+// records are left alone.
+func (r *Record) normalize() {
+	rrdatas := slices.Clone(r.Rrdatas)
+	slices.SortStableFunc(rrdatas, func(a, b string) int {
+		return strings.Compare(canonicalRrdata(r.Type, a), canonicalRrdata(r.Type, b))
+	})
+	r.Rrdatas = slices.CompactFunc(rrdatas, func(a, b string) bool {
+		return canonicalRrdata(r.Type, a) == canonicalRrdata(r.Type, b)
+	})
+}
+
+// merge adds the rrdatas from other into r.  r keeps its own TTL.
+func (r *Record) merge(other *Record) {
+	r.Rrdatas = append(slices.Clone(r.Rrdatas), other.Rrdatas...)
+	r.normalize()
+}
+
+// managedUser is implemented by providers that check which records
+// they may remove.  NewProviders uses it to hand out the config's
+// Managed.
+type managedUser interface {
+	setManaged(m *Managed)
+}
+
+// IsManaged returns true if the record is of a type that m manages,
+// or is one of m.Registry's TXT records.  A nil m is the same as
+// DefaultManaged().
+func (r *Record) IsManaged(m *Managed) bool {
+	if m == nil {
+		m = DefaultManaged()
+	}
+	return m.Types[r.Type] || m.Registry.isOwnTXT(r)
+}
+
+// recordFromRR converts a dns.RR into a netbox2dns Record.
+func recordFromRR(rr dns.RR) *Record {
+	h := rr.Header()
+	return &Record{
+		Name:    strings.ToLower(h.Name),
+		Type:    dns.TypeToString[h.Rrtype],
+		TTL:     int64(h.Ttl),
+		Rrdatas: []string{strings.TrimPrefix(rr.String(), h.String())},
+	}
+}
+
+// rrsFromRecord converts a netbox2dns Record into a list of dns.RRs,
+// one per Rrdata.
+func rrsFromRecord(r *Record) ([]dns.RR, error) {
+	rrs := make([]dns.RR, len(r.Rrdatas))
+	for i, rrdata := range r.Rrdatas {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(r.Name), r.TTL, r.Type, rrdata))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse record %q: %v", r.Name, err)
+		}
+		rrs[i] = rr
+	}
+	return rrs, nil
+}
@@ -0,0 +1,169 @@
+package netbox2dns
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/golang/glog"
+)
+
+// registryHeritage starts the text of every TXT registry record.
+const registryHeritage = "heritage=netbox2dns,"
+
+// Registry tracks which DNS names are owned by netbox2dns, in the
+// style of external-dns.  For each name that netbox2dns creates, it
+// also creates a TXT record like:
+//
+//	_netbox2dns.www.example.com. IN TXT "heritage=netbox2dns,netbox2dns/owner=default"
+//
+// When a registry is in use, netbox2dns only removes records from
+// names that it owns, so `delete_entries` can be used in zones that
+// are shared with people or other tools.
+type Registry struct {
+	OwnerID string
+	Prefix  string
+}
+
+// NewRegistry creates a new Registry from the config.  It returns nil
+// if the registry is disabled.
+func NewRegistry(cr ConfigRegistry) *Registry {
+	if cr.Mode != "txt" {
+		return nil
+	}
+	return &Registry{
+		OwnerID: cr.OwnerID,
+		Prefix:  strings.ToLower(cr.TXTPrefix), // Zone.Records keys are lower case
+
+	}
+}
+
+// TXTName returns the name of the TXT record that marks name as owned.
+func (r *Registry) TXTName(name string) string {
+	return r.Prefix + name
+}
+
+// TXTValue returns the rrdata of this registry's TXT records.
+func (r *Registry) TXTValue() string {
+	return fmt.Sprintf("%q", registryHeritage+"netbox2dns/owner="+r.OwnerID)
+}
+
+// isRegistryTXT returns true if a record is a TXT registry record
+// created by any netbox2dns owner.
+func isRegistryTXT(rec *Record) bool {
+	if rec.Type != "TXT" {
+		return false
+	}
+	for _, rrdata := range rec.Rrdatas {
+		if strings.HasPrefix(rrdata, `"`+registryHeritage) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOwnTXT returns true if rec is one of this registry's TXT records.
+// A nil Registry has no records.
+func (r *Registry) isOwnTXT(rec *Record) bool {
+	if r == nil || rec.Type != "TXT" {
+		return false
+	}
+	for _, rrdata := range rec.Rrdatas {
+		if rrdata == r.TXTValue() {
+			return true
+		}
+	}
+	return false
+}
+
+// Owns returns true if zone contains this registry's TXT record for
+// name.
+func (r *Registry) Owns(zone *Zone, name string) bool {
+	for _, rec := range zone.Records[r.TXTName(name)] {
+		if r.isOwnTXT(rec) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddRecords adds a TXT registry record to zone for every name with
+// records managed by m.
+func (r *Registry) AddRecords(zone *Zone, m *Managed) {
+	if r == nil {
+		return
+	}
+	names := []string{}
+	for name, records := range zone.Records {
+		for _, rec := range records {
+			if rec.IsManaged(m) && !isRegistryTXT(rec) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	for _, name := range names {
+		txt := &Record{
+			Name:    r.TXTName(name),
+			Type:    "TXT",
+			Rrdatas: []string{r.TXTValue()},
+		}
+		if !hasRecord(zone.Records[txt.Name], txt) {
+			zone.AddRecord(txt)
+		}
+	}
+}
+
+// FilterDelta removes changes that would touch names that this
+// registry doesn't own.  Records are only removed from owned names,
+// and TXT registry records are only removed if they belong to this
+// owner.  Names that already hold managed records that Netbox doesn't
+// know about aren't claimed, so records created by hand are never
+// adopted.
+func (r *Registry) FilterDelta(older, newer *Zone, zd *ZoneDelta, m *Managed) {
+	if r == nil {
+		return
+	}
+
+	for name, records := range zd.RemoveRecords {
+		keep := []*Record{}
+		for _, rec := range records {
+			if isRegistryTXT(rec) {
+				if r.isOwnTXT(rec) {
+					keep = append(keep, rec)
+				}
+			} else if r.Owns(older, name) {
+				keep = append(keep, rec)
+			}
+		}
+		if len(keep) == 0 {
+			delete(zd.RemoveRecords, name)
+		} else {
+			zd.RemoveRecords[name] = keep
+		}
+	}
+
+	for txtName, records := range zd.AddRecords {
+		name, ok := strings.CutPrefix(txtName, r.Prefix)
+		if !ok || !r.hasOwnTXT(records) || r.Owns(older, name) {
+			continue
+		}
+		for _, rec := range older.Records[name] {
+			if rec.IsManaged(m) && !hasRecord(newer.Records[name], rec) {
+				log.Warningf("Not claiming %q in zone %q; it has records that netbox2dns doesn't own", name, zd.Key())
+				delete(zd.AddRecords, txtName)
+				break
+			}
+		}
+	}
+}
+
+// hasOwnTXT returns true if records contains one of this registry's
+// TXT records.
+func (r *Registry) hasOwnTXT(records []*Record) bool {
+	for _, rec := range records {
+		if r.isOwnTXT(rec) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package netbox2dns
+
+import (
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	reg := NewRegistry(ConfigRegistry{Mode: "txt", OwnerID: "test", TXTPrefix: "_netbox2dns."})
+	other := &Registry{OwnerID: "other", Prefix: "_netbox2dns."}
+
+	older := &Zone{Name: "example.com", DeleteEntries: true, Records: make(map[string][]*Record)}
+	for _, r := range []*Record{
+		// Owned by us, and no longer in Netbox.
+		{Name: "old.example.com.", Type: "A", Rrdatas: []string{"10.0.0.1"}},
+		{Name: "_netbox2dns.old.example.com.", Type: "TXT", Rrdatas: []string{reg.TXTValue()}},
+		// Created by hand.
+		{Name: "manual.example.com.", Type: "A", Rrdatas: []string{"10.0.0.2"}},
+		// Owned by another instance.
+		{Name: "theirs.example.com.", Type: "A", Rrdatas: []string{"10.0.0.3"}},
+		{Name: "_netbox2dns.theirs.example.com.", Type: "TXT", Rrdatas: []string{other.TXTValue()}},
+		// Created by hand, but Netbox now has a different address.
+		{Name: "conflict.example.com.", Type: "A", Rrdatas: []string{"10.0.0.4"}},
+		// Created before the registry was enabled; matches Netbox.
+		{Name: "adopt.example.com.", Type: "A", Rrdatas: []string{"10.0.0.5"}},
+	} {
+		older.AddRecord(r)
+	}
+
+	newer := &Zone{Name: "example.com", Records: make(map[string][]*Record)}
+	for _, r := range []*Record{
+		{Name: "conflict.example.com.", Type: "A", Rrdatas: []string{"10.0.0.40"}},
+		{Name: "adopt.example.com.", Type: "A", Rrdatas: []string{"10.0.0.5"}},
+		{Name: "new.example.com.", Type: "A", Rrdatas: []string{"10.0.0.6"}},
+	} {
+		newer.AddRecord(r)
+	}
+	reg.AddRecords(newer, DefaultManaged())
+	reg.AddRecords(newer, DefaultManaged()) // Should be idempotent.
+
+	if len(newer.Records["_netbox2dns.new.example.com."]) != 1 {
+		t.Fatalf("AddRecords() wrong; got %v", newer.Records)
+	}
+
+	zd := older.NewZoneDelta()
+	older.Compare(newer, zd)
+	reg.FilterDelta(older, newer, zd, DefaultManaged())
+
+	wantRemove := []string{"old.example.com.", "_netbox2dns.old.example.com."}
+	if len(zd.RemoveRecords) != len(wantRemove) {
+		t.Errorf("RemoveRecords wrong; got %v want %v", zd.RemoveRecords, wantRemove)
+	}
+	for _, name := range wantRemove {
+		if zd.RemoveRecords[name] == nil {
+			t.Errorf("RemoveRecords missing %q", name)
+		}
+	}
+
+	wantAdd := []string{
+		"conflict.example.com.",
+		"new.example.com.",
+		"_netbox2dns.new.example.com.",
+		"_netbox2dns.adopt.example.com.",
+	}
+	if len(zd.AddRecords) != len(wantAdd) {
+		t.Errorf("AddRecords wrong; got %v want %v", zd.AddRecords, wantAdd)
+	}
+	for _, name := range wantAdd {
+		if zd.AddRecords[name] == nil {
+			t.Errorf("AddRecords missing %q", name)
+		}
+	}
+}
+
+func TestRegistryDisabled(t *testing.T) {
+	reg := NewRegistry(ConfigRegistry{Mode: "none"})
+	if reg != nil {
+		t.Fatalf("NewRegistry() with mode none: got %+v want nil", reg)
+	}
+
+	// A nil Registry should be a no-op.
+	zone := &Zone{Name: "example.com", Records: make(map[string][]*Record)}
+	zone.AddRecord(&Record{Name: "a.example.com.", Type: "A", Rrdatas: []string{"10.0.0.1"}})
+	reg.AddRecords(zone, DefaultManaged())
+	if len(zone.Records) != 1 {
+		t.Errorf("nil Registry added records: %v", zone.Records)
+	}
+
+	// Without a registry, even netbox2dns's TXT records are left
+	// alone.
+	other := &Registry{OwnerID: "other", Prefix: "_netbox2dns."}
+	txt := &Record{Name: "_netbox2dns.a.example.com.", Type: "TXT", Rrdatas: []string{other.TXTValue()}}
+	if txt.IsManaged(DefaultManaged()) {
+		t.Errorf("IsManaged() of a registry TXT record without a registry: got true, want false")
+	}
+}
+
+func TestRegistryManaged(t *testing.T) {
+	cfg := &Config{Registry: ConfigRegistry{Mode: "txt", OwnerID: "test", TXTPrefix: "_netbox2dns."}}
+	m := cfg.Managed()
+	other := &Registry{OwnerID: "other", Prefix: "_netbox2dns."}
+
+	tests := []struct {
+		rec  *Record
+		want bool
+	}{
+		{&Record{Name: "_netbox2dns.a.example.com.", Type: "TXT", Rrdatas: []string{m.Registry.TXTValue()}}, true},
+		{&Record{Name: "_netbox2dns.b.example.com.", Type: "TXT", Rrdatas: []string{other.TXTValue()}}, false},
+		{&Record{Name: "example.com.", Type: "TXT", Rrdatas: []string{`"v=spf1 -all"`}}, false},
+		{&Record{Name: "a.example.com.", Type: "A", Rrdatas: []string{"10.0.0.1"}}, true},
+	}
+	for _, test := range tests {
+		if got := test.rec.IsManaged(m); got != test.want {
+			t.Errorf("IsManaged(%s %s %v): got %v, want %v", test.rec.Name, test.rec.Type, test.rec.Rrdatas, got, test.want)
+		}
+	}
+}
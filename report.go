@@ -0,0 +1,245 @@
+package netbox2dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Zone and run outcomes in a Report.
+const (
+	StatusOK      = "ok"
+	StatusPartial = "partial" // Some changes failed
+	StatusFailed  = "failed"  // Nothing was changed
+)
+
+// ZoneErrors holds errors for individual zones, keyed by zone key
+// (see ConfigZone.Key).  It's returned when some zones fail and the
+// rest carry on.
+type ZoneErrors map[string]error
+
+// Error lists every failed zone, sorted by zone key.
+func (ze ZoneErrors) Error() string {
+	keys := make([]string, 0, len(ze))
+	for k := range ze {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	msgs := make([]string, len(keys))
+	for i, k := range keys {
+		msgs[i] = fmt.Sprintf("zone %q: %v", k, ze[k])
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// add records an error for a zone.
+func (ze ZoneErrors) add(key string, err error) {
+	ze[key] = err
+}
+
+// orNil returns ze as an error, or nil if there are no errors.
+func (ze ZoneErrors) orNil() error {
+	if len(ze) == 0 {
+		return nil
+	}
+	return ze
+}
+
+// Report is a summary of what happened to each zone during a run.
+// This is part of the JSON and YAML output of `push` and `apply`, so
+// fields should only be added, never renamed or removed.  It's safe
+// to update a Report from several goroutines.
+type Report struct {
+	Status string        `json:"status" yaml:"status"`
+	Zones  []*ZoneReport `json:"zones" yaml:"zones"`
+
+	mu sync.Mutex
+}
+
+// ZoneReport describes what happened to a single zone.
+type ZoneReport struct {
+	Zone     string          `json:"zone" yaml:"zone"` // Zone key, like "example.com" or "lab/example.com"
+	Provider string          `json:"provider" yaml:"provider"`
+	Status   string          `json:"status" yaml:"status"`
+	Applied  int             `json:"applied" yaml:"applied"`
+	Errors   []string        `json:"errors,omitempty" yaml:"errors,omitempty"` // Errors for the zone as a whole
+	Failed   []*FailedChange `json:"failed,omitempty" yaml:"failed,omitempty"`
+}
+
+// FailedChange is a Change that a provider couldn't make.
+type FailedChange struct {
+	Change `yaml:",inline"`
+	Error  string `json:"error" yaml:"error"`
+}
+
+// NewReport creates a Report with an entry for each zone in the
+// config, all with StatusOK.
+func NewReport(cfg *Config) *Report {
+	r := &Report{Status: StatusOK, Zones: []*ZoneReport{}}
+	for k, cz := range cfg.ZoneMap {
+		r.Zones = append(r.Zones, &ZoneReport{Zone: k, Provider: cz.ZoneType, Status: StatusOK})
+	}
+	r.sort()
+	return r
+}
+
+func (r *Report) sort() {
+	sort.Slice(r.Zones, func(i, j int) bool {
+		return r.Zones[i].Zone < r.Zones[j].Zone
+	})
+}
+
+// Zone returns the entry for a zone key, adding one if needed.
+func (r *Report) Zone(key string) *ZoneReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.zone(key)
+}
+
+func (r *Report) zone(key string) *ZoneReport {
+	for _, zr := range r.Zones {
+		if zr.Zone == key {
+			return zr
+		}
+	}
+	zr := &ZoneReport{Zone: key, Status: StatusOK}
+	r.Zones = append(r.Zones, zr)
+	r.sort()
+	return zr
+}
+
+// ZoneError marks a whole zone as failed.
+func (r *Report) ZoneError(key string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	zr := r.zone(key)
+	zr.Status = StatusFailed
+	zr.Errors = append(zr.Errors, err.Error())
+	r.update()
+}
+
+// AddZoneErrors marks every zone in ze as failed.
+func (r *Report) AddZoneErrors(ze ZoneErrors) {
+	for k, err := range ze {
+		r.ZoneError(k, err)
+	}
+}
+
+// zoneFailed returns true if a zone has already failed.
+func (r *Report) zoneFailed(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.zone(key).Status == StatusFailed
+}
+
+// changeApplied records a change that was made and saved.
+func (r *Report) changeApplied(c *Change) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.zone(c.Key()).Applied++
+}
+
+// changeFailed records a change that a provider couldn't make.
+func (r *Report) changeFailed(c *Change, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	zr := r.zone(c.Key())
+	zr.Failed = append(zr.Failed, &FailedChange{Change: *c, Error: err.Error()})
+	if zr.Status == StatusOK {
+		zr.Status = StatusPartial
+	}
+	r.update()
+}
+
+// zoneDone is called after all of a zone's changes have been tried.
+// A zone where every change failed is marked StatusFailed.
+func (r *Report) zoneDone(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	zr := r.zone(key)
+	if zr.Status == StatusPartial && zr.Applied == 0 {
+		zr.Status = StatusFailed
+	}
+	r.update()
+}
+
+// update sets the overall Status: StatusOK if every zone is OK,
+// StatusFailed if every zone failed, and StatusPartial otherwise.
+// Callers must hold r.mu.
+func (r *Report) update() {
+	ok, failed := 0, 0
+	for _, zr := range r.Zones {
+		switch zr.Status {
+		case StatusOK:
+			ok++
+		case StatusFailed:
+			failed++
+		}
+	}
+	switch {
+	case ok == len(r.Zones):
+		r.Status = StatusOK
+	case failed == len(r.Zones):
+		r.Status = StatusFailed
+	default:
+		r.Status = StatusPartial
+	}
+}
+
+// Err returns an error describing the failed zones, or nil if every
+// zone is OK.
+func (r *Report) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Status == StatusOK {
+		return nil
+	}
+	bad := []string{}
+	for _, zr := range r.Zones {
+		if zr.Status != StatusOK {
+			bad = append(bad, fmt.Sprintf("%q (%s)", zr.Zone, zr.Status))
+		}
+	}
+	return fmt.Errorf("%d of %d zones had errors: %s", len(bad), len(r.Zones), strings.Join(bad, ", "))
+}
+
+// Write writes the report to w in the given format: "text", "json", or
+// "yaml".  The text format has one line per zone, followed by one line
+// per error.
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case "text", "":
+		for _, zr := range r.Zones {
+			_, err := fmt.Fprintf(w, "%s: %s, %d changes applied, %d failed\n", zr.Zone, zr.Status, zr.Applied, len(zr.Failed))
+			if err != nil {
+				return err
+			}
+			for _, e := range zr.Errors {
+				fmt.Fprintf(w, "  error: %s\n", e)
+			}
+			for _, f := range zr.Failed {
+				sign := "+"
+				if f.Action == ActionRemove {
+					sign = "-"
+				}
+				fmt.Fprintf(w, "  failed: %s %s %s %d %v: %s\n", sign, f.Name, f.Type, f.TTL, f.Rrdatas, f.Error)
+			}
+		}
+		return nil
+	case "json":
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(r)
+	case "yaml":
+		e := yaml.NewEncoder(w)
+		defer e.Close()
+		return e.Encode(r)
+	}
+	return fmt.Errorf("Unknown output format %q", format)
+}
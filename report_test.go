@@ -0,0 +1,162 @@
+package netbox2dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// flakyProvider is a DNSProvider that fails to write records with a
+// given name, and optionally fails to save.
+type flakyProvider struct {
+	failName string
+	failSave bool
+	saved    bool
+}
+
+func (fp *flakyProvider) ImportZone(ctx context.Context, cz *ConfigZone) (*Zone, error) {
+	return &Zone{Name: cz.Name, Records: make(map[string][]*Record)}, nil
+}
+
+func (fp *flakyProvider) WriteRecord(ctx context.Context, cz *ConfigZone, r *Record) error {
+	if r.Name == fp.failName {
+		return fmt.Errorf("write failed")
+	}
+	return nil
+}
+
+func (fp *flakyProvider) RemoveRecord(ctx context.Context, cz *ConfigZone, r *Record) error {
+	return nil
+}
+
+func (fp *flakyProvider) Save(ctx context.Context, cz *ConfigZone) error {
+	if fp.failSave {
+		return fmt.Errorf("save failed")
+	}
+	fp.saved = true
+	return nil
+}
+
+func TestNewProvidersZoneErrors(t *testing.T) {
+	filename := copyZoneFile(t, "example.com.zone")
+	cfg := &Config{ZoneMap: map[string]*ConfigZone{
+		"example.com": {ZoneType: "zonefile", Name: "example.com", Filename: filename, TTL: 300},
+		"example.net": {ZoneType: "bogus", Name: "example.net"},
+	}}
+
+	providers, err := NewProviders(context.Background(), cfg)
+	var ze ZoneErrors
+	if !errors.As(err, &ze) || len(ze) != 1 || ze["example.net"] == nil {
+		t.Fatalf("NewProviders() error wrong; got %v", err)
+	}
+
+	zones, err := providers.ImportZones(context.Background(), cfg)
+	if !errors.As(err, &ze) || len(ze) != 1 || ze["example.net"] == nil {
+		t.Fatalf("ImportZones() error wrong; got %v", err)
+	}
+	if zones.Zones["example.com"] == nil || zones.Zones["example.net"] != nil {
+		t.Errorf("ImportZones() zones wrong; got %v", zones.Zones)
+	}
+}
+
+func TestApplyReport(t *testing.T) {
+	cfg := &Config{ZoneMap: map[string]*ConfigZone{
+		"a.example": {ZoneType: "test", Name: "a.example"},
+		"b.example": {ZoneType: "test", Name: "b.example"},
+		"c.example": {ZoneType: "test", Name: "c.example"},
+		"d.example": {ZoneType: "test", Name: "d.example"},
+	}}
+	a := &flakyProvider{}
+	b := &flakyProvider{failName: "bad.b.example."}
+	c := &flakyProvider{failName: "bad.c.example."}
+	providers := Providers{
+		"a.example": a,
+		"b.example": b,
+		"c.example": c,
+		"d.example": &failedProvider{err: fmt.Errorf("no credentials")},
+	}
+
+	add := func(zone, name string) *Change {
+		return &Change{Zone: zone, Action: ActionAdd, Name: name, Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.1"}}
+	}
+	d := &Diff{Changes: []*Change{
+		add("a.example", "ok.a.example."),
+		add("b.example", "bad.b.example."),
+		add("b.example", "ok.b.example."),
+		add("c.example", "bad.c.example."),
+		add("d.example", "ok.d.example."),
+	}}
+
+	report := NewReport(cfg)
+	err := providers.Apply(context.Background(), cfg, d, report)
+	if err == nil {
+		t.Fatalf("Apply() returned nil error, want failures")
+	}
+	if !a.saved || !b.saved || !c.saved {
+		t.Errorf("Apply() didn't save every zone after failures")
+	}
+
+	want := map[string]string{
+		"a.example": StatusOK,
+		"b.example": StatusPartial,
+		"c.example": StatusFailed,
+		"d.example": StatusFailed,
+	}
+	for _, zr := range report.Zones {
+		if zr.Status != want[zr.Zone] {
+			t.Errorf("Zone %q status wrong; got %q want %q", zr.Zone, zr.Status, want[zr.Zone])
+		}
+	}
+	if report.Status != StatusPartial {
+		t.Errorf("report.Status wrong; got %q want %q", report.Status, StatusPartial)
+	}
+
+	b2 := &strings.Builder{}
+	err = report.Write(b2, "text")
+	if err != nil {
+		t.Fatalf("Write() returned error: %v", err)
+	}
+	wantText := `a.example: ok, 1 changes applied, 0 failed
+b.example: partial, 1 changes applied, 1 failed
+  failed: + bad.b.example. A 300 [10.0.0.1]: write failed
+c.example: failed, 0 changes applied, 1 failed
+  failed: + bad.c.example. A 300 [10.0.0.1]: write failed
+d.example: failed, 0 changes applied, 1 failed
+  error: Failed to save zone: no credentials
+  failed: + ok.d.example. A 300 [10.0.0.1]: no credentials
+`
+	if b2.String() != wantText {
+		t.Errorf("Write() wrong;\n got:\n%s\nwant:\n%s", b2.String(), wantText)
+	}
+
+	// Every zone failing is a total failure.
+	report = NewReport(&Config{ZoneMap: map[string]*ConfigZone{"c.example": cfg.ZoneMap["c.example"]}})
+	providers.Apply(context.Background(), cfg, &Diff{Changes: d.Changes[3:4]}, report)
+	if report.Status != StatusFailed {
+		t.Errorf("report.Status wrong; got %q want %q", report.Status, StatusFailed)
+	}
+}
+
+func TestApplyReportSaveFailed(t *testing.T) {
+	cfg := &Config{ZoneMap: map[string]*ConfigZone{
+		"a.example": {ZoneType: "test", Name: "a.example"},
+	}}
+	providers := Providers{"a.example": &flakyProvider{failSave: true}}
+	d := &Diff{Changes: []*Change{
+		{Zone: "a.example", Action: ActionAdd, Name: "ok.a.example.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.1"}},
+		{Zone: "a.example", Action: ActionRemove, Name: "old.a.example.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.2"}},
+	}}
+
+	report := NewReport(cfg)
+	err := providers.Apply(context.Background(), cfg, d, report)
+	if err == nil {
+		t.Fatalf("Apply() returned nil error, want a save failure")
+	}
+	// The writes succeeded, but they were never saved.
+	zr := report.Zone("a.example")
+	if zr.Status != StatusFailed || zr.Applied != 0 {
+		t.Errorf("Zone status wrong; got %q with %d applied, want %q with 0 applied", zr.Status, zr.Applied, StatusFailed)
+	}
+}
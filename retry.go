@@ -0,0 +1,197 @@
+package netbox2dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/googleapi"
+)
+
+// apiCaller makes calls to a DNS provider's API.  Calls that fail with
+// a transient error, like a timeout or an HTTP 429 or 5xx, are retried
+// with exponential backoff and jitter.  If limiter is set, then every
+// attempt waits for a token first.  A single apiCaller is shared by
+// every zone with the same zonetype, so the rate limit applies to all
+// of them together.
+//
+// A nil *apiCaller makes each call once, with no rate limit.
+type apiCaller struct {
+	zoneType string
+	attempts int
+	delay    time.Duration // Before the first retry
+	maxDelay time.Duration
+	limiter  *rate.Limiter // Nil for no limit
+}
+
+// apiCallerUser is implemented by providers that make API calls
+// through an apiCaller.  NewProviders uses it to hand out the shared
+// apiCaller for each zonetype.
+type apiCallerUser interface {
+	setAPICaller(a *apiCaller)
+}
+
+// newAPICallers creates an apiCaller for each zonetype, using the
+// `retry` and `rate_limits` settings from the config.
+func newAPICallers(cfg *Config) (map[string]*apiCaller, error) {
+	delay, maxDelay, err := cfg.Retry.Durations()
+	if err != nil {
+		return nil, err
+	}
+
+	callers := make(map[string]*apiCaller)
+	for _, cz := range cfg.ZoneMap {
+		if callers[cz.ZoneType] != nil {
+			continue
+		}
+		a := &apiCaller{
+			zoneType: cz.ZoneType,
+			attempts: max(cfg.Retry.Attempts, 1),
+			delay:    delay,
+			maxDelay: maxDelay,
+		}
+		if r := cfg.RateLimits[cz.ZoneType]; r > 0 {
+			a.limiter = rate.NewLimiter(rate.Limit(r), max(int(math.Ceil(r)), 1))
+		}
+		callers[cz.ZoneType] = a
+	}
+	return callers, nil
+}
+
+// call runs f, retrying it if it fails with a transient error.  what
+// describes the call for log messages.  The error from the last
+// attempt is returned.
+func (a *apiCaller) call(ctx context.Context, what string, f func() error) error {
+	if a == nil {
+		return f()
+	}
+
+	delay := a.delay
+	for attempt := 1; ; attempt++ {
+		if a.limiter != nil {
+			err := a.limiter.Wait(ctx)
+			if err != nil {
+				return fmt.Errorf("Rate limit for %s: %v", a.zoneType, err)
+			}
+		}
+
+		err := f()
+		if err == nil || attempt >= a.attempts || !isTransient(err) || ctx.Err() != nil {
+			return err
+		}
+
+		// Wait between half and all of the current delay, so
+		// that zones that failed together don't retry together.
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.Warningf("%s: %s failed on attempt %d of %d, retrying in %v: %v", a.zoneType, what, attempt, a.attempts, wait, err)
+		providerRetries.WithLabelValues(a.zoneType).Inc()
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		delay = min(delay*2, a.maxDelay)
+	}
+}
+
+// httpStatusError is returned by providers when an HTTP API returns a
+// non-2xx status.
+type httpStatusError struct {
+	Code int
+	Msg  string
+}
+
+func (e *httpStatusError) Error() string {
+	return e.Msg
+}
+
+// rcodeError is returned by providers when a DNS server answers with
+// an error code.
+type rcodeError struct {
+	Rcode int
+	Msg   string
+}
+
+func (e *rcodeError) Error() string {
+	return e.Msg
+}
+
+// permanentError wraps an error that mustn't be retried, even if it
+// would otherwise be transient.  It's used for calls that aren't safe
+// to repeat.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// isRateLimited returns true if err is a Cloud DNS rate limit error.
+// These requests were rejected without being acted on, so they're safe
+// to retry even when the call isn't idempotent.
+func isRateLimited(err error) bool {
+	var gerr *googleapi.Error
+	if !errors.As(err, &gerr) {
+		return false
+	}
+	if gerr.Code == 429 {
+		return true
+	}
+	for _, e := range gerr.Errors {
+		if e.Reason == "rateLimitExceeded" || e.Reason == "userRateLimitExceeded" {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransient returns true if err might go away if the call is tried
+// again: network timeouts and dropped connections, HTTP 429 and 5xx
+// responses, Cloud DNS rate limit errors, and DNS SERVFAIL responses.
+// Other network errors, like TLS failures, unknown hosts, and bad
+// URLs, won't fix themselves, so they aren't retried.
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var perr *permanentError
+	if errors.As(err, &perr) {
+		return false
+	}
+
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code >= 500 || isRateLimited(err)
+	}
+
+	var herr *httpStatusError
+	if errors.As(err, &herr) {
+		return herr.Code == 429 || herr.Code >= 500
+	}
+
+	var rerr *rcodeError
+	if errors.As(err, &rerr) {
+		return rerr.Rcode == dns.RcodeServerFailure
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE)
+}
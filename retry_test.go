@@ -0,0 +1,222 @@
+package netbox2dns
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/time/rate"
+	clouddns "google.golang.org/api/dns/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{fmt.Errorf("bad record"), false},
+		{context.DeadlineExceeded, false},
+		{&googleapi.Error{Code: 503}, true},
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 409}, false},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, true},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "forbidden"}}}, false},
+		{fmt.Errorf("Unable to get zone: %w", &googleapi.Error{Code: 500}), true},
+		{&httpStatusError{Code: 502}, true},
+		{&httpStatusError{Code: 422}, false},
+		{&rcodeError{Rcode: dns.RcodeServerFailure}, true},
+		{&rcodeError{Rcode: dns.RcodeRefused}, false},
+		{io.ErrUnexpectedEOF, true},
+		{&permanentError{&googleapi.Error{Code: 503}}, false},
+		{fmt.Errorf("Unable to update zone: %w", &net.OpError{Op: "read", Err: syscall.ECONNRESET}), true},
+		{&url.Error{Op: "Get", URL: "https://pdns.example.com", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, true},
+		{&url.Error{Op: "Get", URL: "https://pdns.example.com", Err: timeoutError{}}, true},
+		{&url.Error{Op: "Get", URL: "https://pdns.example.com", Err: &net.DNSError{Err: "no such host", Name: "pdns.example.com", IsNotFound: true}}, false},
+		{&url.Error{Op: "Get", URL: "https://pdns.example.com", Err: x509.UnknownAuthorityError{}}, false},
+		{&url.Error{Op: "Get", URL: "ftp://pdns.example.com", Err: errors.New("unsupported protocol scheme")}, false},
+	}
+
+	for _, test := range tests {
+		if got := isTransient(test.err); got != test.want {
+			t.Errorf("isTransient(%v): got %v want %v", test.err, got, test.want)
+		}
+	}
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestAPICallerCall(t *testing.T) {
+	a := &apiCaller{zoneType: "test", attempts: 3}
+
+	calls := 0
+	err := a.call(context.Background(), "test", func() error {
+		calls++
+		if calls < 3 {
+			return &httpStatusError{Code: 503}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("call() with 2 transient failures: got %v after %d calls, want success after 3", err, calls)
+	}
+
+	calls = 0
+	err = a.call(context.Background(), "test", func() error {
+		calls++
+		return &httpStatusError{Code: 503}
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("call() that always fails: got %v after %d calls, want error after 3", err, calls)
+	}
+
+	calls = 0
+	err = a.call(context.Background(), "test", func() error {
+		calls++
+		return &httpStatusError{Code: 404}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("call() with a permanent failure: got %v after %d calls, want error after 1", err, calls)
+	}
+
+	// Canceling the context stops retries.
+	a.delay, a.maxDelay = time.Hour, time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = 0
+	err = a.call(ctx, "test", func() error {
+		calls++
+		cancel()
+		return &httpStatusError{Code: 503}
+	})
+	if !errors.As(err, new(*httpStatusError)) || calls != 1 {
+		t.Errorf("call() with a canceled context: got %v after %d calls, want the first error", err, calls)
+	}
+
+	// As does running out of rate limit tokens before the deadline.
+	a.limiter = rate.NewLimiter(rate.Every(time.Hour), 1)
+	a.limiter.Allow()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if a.call(ctx, "test", func() error { return nil }) == nil {
+		t.Errorf("call() past its rate limit succeeded, want error")
+	}
+}
+
+func TestPowerDNSRetry(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"name": "example.com.", "rrsets": []}`))
+	}))
+	defer ts.Close()
+
+	cfg := &Config{ZoneMap: map[string]*ConfigZone{
+		"example.com": {ZoneType: "powerdns", Name: "example.com", APIURL: ts.URL},
+	}}
+	cfg.Retry = ConfigRetry{Attempts: 2, Delay: "0s", MaxDelay: "0s"}
+	providers, err := NewProviders(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("NewProviders() returned error: %v", err)
+	}
+	_, err = providers.ImportZones(context.Background(), cfg)
+	if err != nil || calls != 2 {
+		t.Errorf("ImportZones() after a 503: got %v after %d calls, want success after 2", err, calls)
+	}
+}
+
+func TestRFC2136Retry(t *testing.T) {
+	ts := newTestDNSServer(t, "example.com.")
+	ts.drop = 1
+
+	cz := &ConfigZone{
+		ZoneType:   "rfc2136",
+		Name:       "example.com",
+		Server:     ts.addr(),
+		TTL:        300,
+		TSIGName:   "netbox2dns",
+		TSIGSecret: testTSIGSecret,
+	}
+	cfg := &Config{ZoneMap: map[string]*ConfigZone{"example.com": cz}}
+	cfg.Retry = ConfigRetry{Attempts: 2, Delay: "0s", MaxDelay: "0s"}
+	providers, err := NewProviders(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("NewProviders() returned error: %v", err)
+	}
+	p := providers["example.com"].(*RFC2136DNS)
+	p.client.ReadTimeout = 100 * time.Millisecond
+
+	// The first update times out, and is sent again.
+	p.WriteRecord(context.Background(), cz, &Record{Name: "new.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.3"}})
+	err = p.Save(context.Background(), cz)
+	if err != nil || ts.updates != 1 || ts.drop != 0 {
+		t.Errorf("Save() after a timeout: got %v with %d updates, want success after 1 retry", err, ts.updates)
+	}
+}
+
+func TestCloudDNSSaveRetry(t *testing.T) {
+	oldChangePollInterval := changePollInterval
+	t.Cleanup(func() { changePollInterval = oldChangePollInterval })
+	changePollInterval = 0
+
+	tests := []struct {
+		status  int
+		wantErr bool
+		posts   int
+	}{
+		// Rate limited changes weren't applied, so they're sent again.
+		{http.StatusTooManyRequests, false, 2},
+		// Other failures may have been applied, so they aren't.
+		{http.StatusServiceUnavailable, true, 1},
+	}
+
+	for _, test := range tests {
+		posts := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "POST" {
+				posts++
+				if posts == 1 {
+					w.WriteHeader(test.status)
+					return
+				}
+			}
+			json.NewEncoder(w).Encode(&clouddns.Change{Id: "1", Status: "done"})
+		}))
+		defer ts.Close()
+
+		svc, err := clouddns.NewService(context.Background(), option.WithEndpoint(ts.URL), option.WithoutAuthentication())
+		if err != nil {
+			t.Fatalf("Unable to create DNS service: %v", err)
+		}
+		cd := newCloudDNS(svc)
+		cd.setAPICaller(&apiCaller{zoneType: "clouddns", attempts: 3})
+
+		cz := &ConfigZone{Name: "example.com", ZoneName: "example-com", Project: "p"}
+		cd.WriteRecord(context.Background(), cz, &Record{Name: "new.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.2"}})
+		err = cd.Save(context.Background(), cz)
+		if (err != nil) != test.wantErr || posts != test.posts {
+			t.Errorf("Save() after a %d: got %v after %d changes, want error: %v after %d", test.status, err, posts, test.wantErr, test.posts)
+		}
+	}
+}
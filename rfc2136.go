@@ -0,0 +1,231 @@
+package netbox2dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/miekg/dns"
+)
+
+// maxUpdateSize is the largest number of additions plus removals
+// that we'll send in a single DNS UPDATE message.  Larger updates are
+// split into several messages and sent in order.
+const maxUpdateSize = 500
+
+// RFC2136DNS implements talking to a DNS server using AXFR for
+// fetching existing DNS entries and RFC 2136 dynamic updates, signed
+// with TSIG, for adding and removing entries.  This should work with
+// most authoritative servers, including BIND and Knot.
+//
+// Additions and removals are queued up and sent to the server when
+// Save() is called.
+type RFC2136DNS struct {
+	server    string
+	keyName   string
+	algorithm string
+	secret    string
+	client    *dns.Client
+	removals  []dns.RR
+	additions []dns.RR
+	api       *apiCaller
+}
+
+// NewRFC2136DNS creates a new RFC2136DNS.
+func NewRFC2136DNS(ctx context.Context, cz *ConfigZone) (*RFC2136DNS, error) {
+	if cz.Server == "" {
+		return nil, fmt.Errorf("No server specified for zone %q", cz.Name)
+	}
+
+	server := cz.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	rd := &RFC2136DNS{
+		server: server,
+		client: &dns.Client{Net: "tcp"},
+	}
+
+	if cz.TSIGName != "" {
+		algorithm := cz.TSIGAlgorithm
+		if algorithm == "" {
+			algorithm = dns.HmacSHA256
+		}
+		rd.keyName = dns.Fqdn(strings.ToLower(cz.TSIGName))
+		rd.algorithm = dns.Fqdn(strings.ToLower(algorithm))
+		rd.secret = cz.TSIGSecret
+		rd.client.TsigSecret = map[string]string{rd.keyName: rd.secret}
+	}
+
+	return rd, nil
+}
+
+// sign adds a TSIG signature to a message, if a key is configured.
+func (rd *RFC2136DNS) sign(m *dns.Msg) {
+	if rd.keyName != "" {
+		m.SetTsig(rd.keyName, rd.algorithm, 300, time.Now().Unix())
+	}
+}
+
+// setAPICaller sets the apiCaller used to retry and rate limit
+// requests to the DNS server.
+func (rd *RFC2136DNS) setAPICaller(a *apiCaller) {
+	rd.api = a
+}
+
+// ImportZone fetches all entries from the zone's DNS server using
+// AXFR.  Any changes that are still queued from before are dropped.
+func (rd *RFC2136DNS) ImportZone(ctx context.Context, cz *ConfigZone) (*Zone, error) {
+	zone := &Zone{
+		Name:          cz.Name,
+		TTL:           cz.TTL,
+		DeleteEntries: cz.DeleteEntries,
+		IgnoreTTL:     cz.IgnoreTTL,
+		Records:       make(map[string][]*Record),
+	}
+
+	var rrs []dns.RR
+	err := rd.api.call(ctx, "transfer "+cz.Name, func() (err error) {
+		rrs, err = rd.axfr(ctx, cz)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to transfer zone %q from %q: %v", cz.Name, rd.server, err)
+	}
+	rd.discardChanges(cz)
+
+	sawSOA := false
+	for _, rr := range rrs {
+		// AXFR responses start and end with the zone's SOA;
+		// only keep the first copy.
+		if rr.Header().Rrtype == dns.TypeSOA {
+			if sawSOA {
+				continue
+			}
+			sawSOA = true
+		}
+		zone.AddRecord(recordFromRR(rr))
+	}
+
+	return zone, nil
+}
+
+// axfr makes a single attempt to transfer the zone from the server.
+func (rd *RFC2136DNS) axfr(ctx context.Context, cz *ConfigZone) ([]dns.RR, error) {
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(cz.Name))
+	rd.sign(m)
+
+	// dns.Transfer doesn't take a context, so dial the connection
+	// ourselves and close it if ctx is done mid-transfer.
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", rd.server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	t := &dns.Transfer{Conn: &dns.Conn{Conn: conn}}
+	if rd.keyName != "" {
+		t.TsigSecret = map[string]string{rd.keyName: rd.secret}
+	}
+
+	env, err := t.In(m, rd.server)
+	if err != nil {
+		return nil, err
+	}
+
+	var rrs []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	return rrs, nil
+}
+
+// WriteRecord queues a record to be added to the DNS server.  Note
+// that this won't actually be sent until 'Save()' is called.
+func (rd *RFC2136DNS) WriteRecord(ctx context.Context, cz *ConfigZone, r *Record) error {
+	rrs, err := rrsFromRecord(r)
+	if err != nil {
+		return err
+	}
+	rd.additions = append(rd.additions, rrs...)
+	return nil
+}
+
+// RemoveRecord queues a record to be removed from the DNS server.
+// Note that this won't actually be sent until 'Save()' is called.
+func (rd *RFC2136DNS) RemoveRecord(ctx context.Context, cz *ConfigZone, r *Record) error {
+	rrs, err := rrsFromRecord(r)
+	if err != nil {
+		return err
+	}
+	rd.removals = append(rd.removals, rrs...)
+	return nil
+}
+
+// discardChanges drops all queued changes.
+func (rd *RFC2136DNS) discardChanges(cz *ConfigZone) {
+	rd.removals, rd.additions = nil, nil
+}
+
+// Save sends all queued changes to the DNS server as signed DNS
+// UPDATE messages.  Small updates are sent as a single message, which
+// the server applies atomically; larger updates are split into
+// messages of at most maxUpdateSize records each.  Removals are
+// always sent before additions.
+func (rd *RFC2136DNS) Save(ctx context.Context, cz *ConfigZone) error {
+	removals, additions := rd.removals, rd.additions
+	rd.removals, rd.additions = nil, nil
+
+	for len(removals)+len(additions) > 0 {
+		m := new(dns.Msg)
+		m.SetUpdate(dns.Fqdn(cz.Name))
+
+		n := min(len(removals), maxUpdateSize)
+		if n > 0 {
+			m.Remove(removals[:n])
+			removals = removals[n:]
+		}
+		a := min(len(additions), maxUpdateSize-n)
+		if a > 0 {
+			m.Insert(additions[:a])
+			additions = additions[a:]
+		}
+
+		log.Infof("Sending update to %q for zone %q: %d removals, %d additions", rd.server, cz.Name, n, a)
+		err := rd.api.call(ctx, "update "+cz.Name, func() error {
+			// Sending a message strips its TSIG record, so
+			// sign it again for every attempt.
+			rd.sign(m)
+			resp, _, err := rd.client.ExchangeContext(ctx, m, rd.server)
+			if err != nil {
+				return fmt.Errorf("Unable to update zone %q on %q: %w", cz.Name, rd.server, err)
+			}
+			if resp.Rcode != dns.RcodeSuccess {
+				return &rcodeError{
+					Rcode: resp.Rcode,
+					Msg:   fmt.Sprintf("Update of zone %q on %q failed: %s", cz.Name, rd.server, dns.RcodeToString[resp.Rcode]),
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,265 @@
+package netbox2dns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	testTSIGName   = "netbox2dns."
+	testTSIGSecret = "c2VjcmV0c2VjcmV0c2VjcmV0"
+)
+
+// testDNSServer is a minimal in-process authoritative DNS server that
+// supports AXFR and RFC 2136 updates, for testing RFC2136DNS.
+type testDNSServer struct {
+	mu      sync.Mutex
+	zone    string
+	records []dns.RR
+	updates int
+	drop    int // Number of updates to ignore without answering
+	server  *dns.Server
+}
+
+func newTestDNSServer(t *testing.T, zone string, records ...string) *testDNSServer {
+	ts := &testDNSServer{zone: zone}
+	for _, s := range append([]string{zone + " 300 IN SOA ns1." + zone + " hostmaster." + zone + " 1 3600 600 86400 300"}, records...) {
+		ts.records = append(ts.records, mustRR(t, s))
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+
+	started := make(chan struct{})
+	ts.server = &dns.Server{
+		Listener:          l,
+		Net:               "tcp",
+		Handler:           ts,
+		TsigSecret:        map[string]string{testTSIGName: testTSIGSecret},
+		MsgAcceptFunc:     func(dh dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go ts.server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { ts.server.Shutdown() })
+
+	return ts
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("Unable to parse %q: %v", s, err)
+	}
+	return rr
+}
+
+func (ts *testDNSServer) addr() string {
+	return ts.server.Listener.Addr().String()
+}
+
+func (ts *testDNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	tsig := r.IsTsig()
+	if tsig == nil || w.TsigStatus() != nil {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNotAuth)
+		w.WriteMsg(m)
+		return
+	}
+
+	if r.Opcode == dns.OpcodeUpdate {
+		if ts.drop > 0 {
+			ts.drop--
+			return
+		}
+		for _, rr := range r.Ns {
+			switch rr.Header().Class {
+			case dns.ClassNONE:
+				for i, old := range ts.records {
+					rr.Header().Class = dns.ClassINET
+					rr.Header().Ttl = old.Header().Ttl
+					if dns.IsDuplicate(old, rr) {
+						ts.records = append(ts.records[:i], ts.records[i+1:]...)
+						break
+					}
+				}
+			case dns.ClassINET:
+				ts.records = append(ts.records, rr)
+			}
+		}
+		ts.updates++
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+		w.WriteMsg(m)
+		return
+	}
+
+	if len(r.Question) == 1 && r.Question[0].Qtype == dns.TypeAXFR {
+		ch := make(chan *dns.Envelope, 1)
+		ch <- &dns.Envelope{RR: append(append([]dns.RR{}, ts.records...), ts.records[0])}
+		close(ch)
+		tr := new(dns.Transfer)
+		tr.Out(w, r, ch)
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNotImplemented)
+	w.WriteMsg(m)
+}
+
+func TestRFC2136(t *testing.T) {
+	ts := newTestDNSServer(t, "example.com.",
+		"router1.example.com. 300 IN A 10.0.0.1",
+		"old.example.com. 300 IN A 10.0.0.2",
+	)
+
+	cz := &ConfigZone{
+		ZoneType:   "rfc2136",
+		Name:       "example.com",
+		Server:     ts.addr(),
+		TTL:        300,
+		TSIGName:   "netbox2dns",
+		TSIGSecret: testTSIGSecret,
+	}
+
+	p, err := NewDNSProvider(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("NewDNSProvider() returned error: %v", err)
+	}
+
+	zone, err := p.ImportZone(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("ImportZone() returned error: %v", err)
+	}
+	if len(zone.Records["example.com."]) != 1 {
+		t.Errorf("ImportZone(): got %d records for example.com., want 1 SOA", len(zone.Records["example.com."]))
+	}
+	r := zone.Records["router1.example.com."]
+	if len(r) != 1 || r[0].Type != "A" || r[0].Rrdatas[0] != "10.0.0.1" {
+		t.Errorf("ImportZone(): got %+v for router1.example.com.", r)
+	}
+
+	err = p.RemoveRecord(context.Background(), cz, &Record{Name: "old.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.2"}})
+	if err != nil {
+		t.Fatalf("RemoveRecord() returned error: %v", err)
+	}
+	err = p.WriteRecord(context.Background(), cz, &Record{Name: "new.example.com.", Type: "AAAA", TTL: 300, Rrdatas: []string{"2001:db8::1"}})
+	if err != nil {
+		t.Fatalf("WriteRecord() returned error: %v", err)
+	}
+	if ts.updates != 0 {
+		t.Errorf("Updates sent before Save(): got %d, want 0", ts.updates)
+	}
+
+	err = p.Save(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("Save() returned error: %v", err)
+	}
+	if ts.updates != 1 {
+		t.Errorf("Save() sent %d updates, want 1", ts.updates)
+	}
+
+	zone, err = p.ImportZone(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("ImportZone() returned error: %v", err)
+	}
+	if zone.Records["old.example.com."] != nil {
+		t.Errorf("old.example.com. was not removed: %+v", zone.Records["old.example.com."])
+	}
+	r = zone.Records["new.example.com."]
+	if len(r) != 1 || r[0].Type != "AAAA" || r[0].Rrdatas[0] != "2001:db8::1" {
+		t.Errorf("new.example.com. was not added: got %+v", r)
+	}
+}
+
+func TestRFC2136BadKey(t *testing.T) {
+	ts := newTestDNSServer(t, "example.com.")
+
+	cz := &ConfigZone{
+		ZoneType:   "rfc2136",
+		Name:       "example.com",
+		Server:     ts.addr(),
+		TSIGName:   "netbox2dns",
+		TSIGSecret: "d3JvbmcgdHNpZyBzZWNyZXQ=",
+	}
+
+	p, err := NewRFC2136DNS(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("NewRFC2136DNS() returned error: %v", err)
+	}
+	p.WriteRecord(context.Background(), cz, &Record{Name: "new.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.3"}})
+	err = p.Save(context.Background(), cz)
+	if err == nil {
+		t.Errorf("Save() with the wrong TSIG key should have failed")
+	}
+}
+
+// cancelingProvider cancels a context after its first WriteRecord, to
+// interrupt a push partway through.
+type cancelingProvider struct {
+	*RFC2136DNS
+	cancel context.CancelFunc
+}
+
+func (cp *cancelingProvider) WriteRecord(ctx context.Context, cz *ConfigZone, r *Record) error {
+	defer cp.cancel()
+	return cp.RFC2136DNS.WriteRecord(ctx, cz, r)
+}
+
+func TestRFC2136DiscardChanges(t *testing.T) {
+	ts := newTestDNSServer(t, "example.com.")
+
+	cz := &ConfigZone{
+		ZoneType:   "rfc2136",
+		Name:       "example.com",
+		Server:     ts.addr(),
+		TTL:        300,
+		TSIGName:   "netbox2dns",
+		TSIGSecret: testTSIGSecret,
+	}
+	p, err := NewRFC2136DNS(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("NewRFC2136DNS() returned error: %v", err)
+	}
+
+	// Changes queued before an import are dropped.
+	p.WriteRecord(context.Background(), cz, &Record{Name: "stale.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.1"}})
+	_, err = p.ImportZone(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("ImportZone() returned error: %v", err)
+	}
+	err = p.Save(context.Background(), cz)
+	if err != nil || ts.updates != 0 {
+		t.Errorf("Save() after ImportZone(): got %v with %d updates, want no updates", err, ts.updates)
+	}
+
+	// As are changes from a push that's interrupted before Save.
+	cfg := &Config{ZoneMap: map[string]*ConfigZone{"example.com": cz}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	providers := Providers{"example.com": &cancelingProvider{RFC2136DNS: p, cancel: cancel}}
+	add := func(name string) *Change {
+		return &Change{Zone: "example.com", Action: ActionAdd, Name: name, Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.2"}}
+	}
+	report := NewReport(cfg)
+	providers.Apply(ctx, cfg, &Diff{Changes: []*Change{add("a.example.com."), add("b.example.com.")}}, report)
+	if report.Status != StatusFailed {
+		t.Errorf("Apply() with an interrupted push: got status %q, want %q", report.Status, StatusFailed)
+	}
+	err = p.Save(context.Background(), cz)
+	if err != nil || ts.updates != 0 {
+		t.Errorf("Save() after an interrupted push: got %v with %d updates, want no updates", err, ts.updates)
+	}
+}
@@ -0,0 +1,46 @@
+package netbox2dns
+
+import (
+	"fmt"
+)
+
+// CountManaged returns the number of managed records (A, AAAA, PTR,
+// and so on) in a set of records, counting each rrdata separately.
+func CountManaged(records map[string][]*Record, m *Managed) int {
+	n := 0
+	for _, rs := range records {
+		for _, r := range rs {
+			if r.IsManaged(m) {
+				n += len(r.Rrdatas)
+			}
+		}
+	}
+	return n
+}
+
+// CheckDeletions returns an error if applying zd would remove more
+// records from zone than cz's `max_deletions` or
+// `max_deletion_percent` allow.  zone is the current, imported, copy
+// of the zone.  This is meant to catch cases where Netbox returns far
+// fewer addresses than it should, for instance during an outage.
+func CheckDeletions(zd *ZoneDelta, zone *Zone, cz *ConfigZone, m *Managed) error {
+	removals := CountManaged(zd.RemoveRecords, m)
+	if removals == 0 {
+		return nil
+	}
+
+	if cz.MaxDeletions > 0 && int64(removals) > cz.MaxDeletions {
+		return fmt.Errorf("Zone %q would remove %d records, more than max_deletions (%d)", zd.Key(), removals, cz.MaxDeletions)
+	}
+
+	if cz.MaxDeletionPercent > 0 && zone != nil {
+		total := CountManaged(zone.Records, m)
+		if total > 0 {
+			percent := float64(removals) * 100 / float64(total)
+			if percent > cz.MaxDeletionPercent {
+				return fmt.Errorf("Zone %q would remove %d of %d records (%.1f%%), more than max_deletion_percent (%g%%)", zd.Key(), removals, total, percent, cz.MaxDeletionPercent)
+			}
+		}
+	}
+	return nil
+}
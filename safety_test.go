@@ -0,0 +1,41 @@
+package netbox2dns
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCheckDeletions(t *testing.T) {
+	zone := &Zone{Name: "example.com", Records: make(map[string][]*Record)}
+	for i := 1; i <= 10; i++ {
+		zone.AddRecord(&Record{Name: fmt.Sprintf("h%d.example.com.", i), Type: "A", Rrdatas: []string{fmt.Sprintf("10.0.0.%d", i)}})
+	}
+	zone.AddRecord(&Record{Name: "example.com.", Type: "NS", Rrdatas: []string{"ns1.example.com."}})
+
+	zd := zone.NewZoneDelta()
+	for i := 1; i <= 3; i++ {
+		name := fmt.Sprintf("h%d.example.com.", i)
+		zd.RemoveRecords[name] = zone.Records[name]
+	}
+
+	tests := []struct {
+		maxCount   int64
+		maxPercent float64
+		wantErr    bool
+	}{
+		{0, 0, false},
+		{3, 0, false},
+		{2, 0, true},
+		{0, 30, false},
+		{0, 29.9, true},
+		{10, 10, true},
+	}
+
+	for _, test := range tests {
+		cz := &ConfigZone{Name: "example.com", MaxDeletions: test.maxCount, MaxDeletionPercent: test.maxPercent}
+		err := CheckDeletions(zd, zone, cz, DefaultManaged())
+		if (err != nil) != test.wantErr {
+			t.Errorf("CheckDeletions(count=%d, percent=%g): got error %v, want error %v", test.maxCount, test.maxPercent, err, test.wantErr)
+		}
+	}
+}
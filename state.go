@@ -0,0 +1,68 @@
+package netbox2dns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// State is saved between runs in the file named by `safety.state_file`,
+// so that each run can be compared with the last one.
+type State struct {
+	IPAddressCount int       `json:"ip_address_count"`
+	Updated        time.Time `json:"updated"`
+}
+
+// LoadState reads a State from a file.  If the file doesn't exist,
+// then nil is returned with no error.
+func LoadState(filename string) (*State, error) {
+	b, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read state file %q: %v", filename, err)
+	}
+
+	s := &State{}
+	err = json.Unmarshal(b, s)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse state file %q: %v", filename, err)
+	}
+	return s, nil
+}
+
+// Save writes a State to a file, replacing it atomically.
+func (s *State) Save(filename string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(filename, append(b, '\n'))
+	if err != nil {
+		return fmt.Errorf("Unable to write state file %q: %v", filename, err)
+	}
+	return nil
+}
+
+// CheckAddressCount returns an error if count is more than
+// maxDropPercent percent lower than the IP address count in the
+// previous state.  A nil previous state, or a maxDropPercent of 0,
+// always passes.
+func CheckAddressCount(previous *State, count int, maxDropPercent float64) error {
+	if previous == nil || previous.IPAddressCount == 0 || maxDropPercent <= 0 {
+		return nil
+	}
+	if count >= previous.IPAddressCount {
+		return nil
+	}
+
+	drop := float64(previous.IPAddressCount-count) * 100 / float64(previous.IPAddressCount)
+	if drop > maxDropPercent {
+		return fmt.Errorf("Netbox returned %d IP addresses, down %.1f%% from %d on %s, more than max_address_drop_percent (%g%%)",
+			count, drop, previous.IPAddressCount, previous.Updated.Format(time.RFC3339), maxDropPercent)
+	}
+	return nil
+}
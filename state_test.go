@@ -0,0 +1,55 @@
+package netbox2dns
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestState(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state.json")
+
+	s, err := LoadState(filename)
+	if err != nil || s != nil {
+		t.Fatalf("LoadState() of a missing file: got %+v, %v want nil, nil", s, err)
+	}
+
+	want := &State{IPAddressCount: 1000, Updated: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	err = want.Save(filename)
+	if err != nil {
+		t.Fatalf("Save() returned error: %v", err)
+	}
+
+	s, err = LoadState(filename)
+	if err != nil {
+		t.Fatalf("LoadState() returned error: %v", err)
+	}
+	if s.IPAddressCount != want.IPAddressCount || !s.Updated.Equal(want.Updated) {
+		t.Errorf("LoadState() wrong; got %+v want %+v", s, want)
+	}
+}
+
+func TestCheckAddressCount(t *testing.T) {
+	previous := &State{IPAddressCount: 1000}
+
+	tests := []struct {
+		previous   *State
+		count      int
+		maxPercent float64
+		wantErr    bool
+	}{
+		{nil, 0, 10, false},
+		{previous, 0, 0, false},
+		{previous, 1200, 10, false},
+		{previous, 900, 10, false},
+		{previous, 899, 10, true},
+		{previous, 0, 10, true},
+	}
+
+	for _, test := range tests {
+		err := CheckAddressCount(test.previous, test.count, test.maxPercent)
+		if (err != nil) != test.wantErr {
+			t.Errorf("CheckAddressCount(%+v, %d, %g): got error %v, want error %v", test.previous, test.count, test.maxPercent, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package netbox2dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/golang/glog"
+)
+
+// Syncer runs the whole netbox2dns pipeline: import zones from DNS,
+// fetch IP addresses from Netbox, build new zones from them, compare
+// the two, and push the differences.  DNS providers are created once
+// and reused, so a long-running process can call Sync repeatedly.
+type Syncer struct {
+	Config    *Config
+	Force     bool // Ignore the limits in the `safety` config
+	providers Providers
+}
+
+// SyncResult describes a single run of the Syncer.
+type SyncResult struct {
+	Imported  *Zones  // Zones as they were in DNS
+	Diff      *Diff   // Changes needed to match Netbox
+	Addresses int     // Number of IP addresses fetched from Netbox
+	Warnings  []error // Safety limits that the changes exceed
+	Report    *Report // What happened to each zone
+}
+
+// NewSyncer creates a new Syncer, including a DNS provider for each
+// zone in the config.  Zones whose providers can't be created are
+// logged, and then fail on every run.
+func NewSyncer(ctx context.Context, cfg *Config) (*Syncer, error) {
+	providers, err := NewProviders(ctx, cfg)
+	var ze ZoneErrors
+	if errors.As(err, &ze) {
+		log.Errorf("%v", err)
+	} else if err != nil {
+		return nil, err
+	}
+	return &Syncer{
+		Config:    cfg,
+		providers: providers,
+	}, nil
+}
+
+// Plan imports all zones, fetches addresses from Netbox, and works out
+// what needs to change, without changing anything.  Changes that
+// exceed the deletion limits in the config are listed in the result's
+// Warnings.  If Netbox returns far fewer addresses than last time,
+// then an error is returned unless Force is set.
+//
+// Zones that can't be imported are marked as failed in the result's
+// Report and left out of the Diff; the other zones carry on.
+func (s *Syncer) Plan(ctx context.Context) (*SyncResult, error) {
+	return s.plan(ctx, nil)
+}
+
+// PlanChanges works like Plan, but only includes changes to DNS
+// records for the addresses and names in cs, such as those received
+// from Netbox webhooks.  Every zone is still imported and every
+// address is still fetched from Netbox, so that names shared by
+// several addresses come out right.
+func (s *Syncer) PlanChanges(ctx context.Context, cs *ChangeSet) (*SyncResult, error) {
+	return s.plan(ctx, cs)
+}
+
+// plan implements Plan and PlanChanges.  If cs is nil, then every
+// change is included.
+func (s *Syncer) plan(ctx context.Context, cs *ChangeSet) (*SyncResult, error) {
+	cfg := s.Config
+	r := &SyncResult{Report: NewReport(cfg)}
+
+	imported, importErrs, err := s.importZones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.Imported = imported
+	r.Report.AddZoneErrors(importErrs)
+	log.Infof("Found %d zones", len(imported.Zones))
+
+	newZones, err := NewZonesFromConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create zones: %v", err)
+	}
+
+	start := time.Now()
+	addrs, err := GetNetboxIPAddresses(ctx, cfg.Netbox.Host, cfg.Netbox.Token, newZones.Filter)
+	observeFetch("ip_addresses", start)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to fetch IP Addresses from Netbox: %v", err)
+	}
+	r.Addresses = len(addrs)
+	netboxIPAddresses.Set(float64(len(addrs)))
+	log.Infof("Found %d IP addresses", len(addrs))
+
+	// Make sure that Netbox didn't suddenly lose a lot of addresses.
+	if cfg.Safety.StateFile != "" {
+		state, err := LoadState(cfg.Safety.StateFile)
+		if err != nil {
+			return nil, err
+		}
+		err = CheckAddressCount(state, len(addrs), cfg.Safety.MaxAddressDropPercent)
+		if err != nil {
+			if !s.Force {
+				return nil, err
+			}
+			r.Warnings = append(r.Warnings, err)
+		}
+	}
+
+	if cfg.NeedsHosts() {
+		start := time.Now()
+		newZones.Hosts, err = GetNetboxHosts(ctx, cfg.Netbox.Host, cfg.Netbox.Token)
+		observeFetch("hosts", start)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to fetch devices and VMs from Netbox: %v", err)
+		}
+	}
+
+	err = newZones.AddAddrs(addrs)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to add IP addresses: %v", err)
+	}
+	log.Infof("Created %d zones", len(newZones.Zones))
+
+	// Zones that couldn't be imported were still needed above, so
+	// that records didn't end up in their parent zones.
+	for k := range importErrs {
+		delete(newZones.Zones, k)
+	}
+
+	deltas := imported.Compare(newZones)
+	for _, zd := range deltas {
+		if cs != nil {
+			cs.restrictDelta(imported.Zones[zd.Key()], newZones.Zones[zd.Key()], newZones.Registry, zd)
+		}
+		err := CheckDeletions(zd, imported.Zones[zd.Key()], cfg.ZoneMap[zd.Key()], newZones.Managed)
+		if err != nil {
+			log.Warningf("%v", err)
+			r.Warnings = append(r.Warnings, err)
+		}
+	}
+	r.Diff = NewDiff(deltas, cfg)
+	if cs == nil {
+		recordZoneMetrics(cfg, imported, newZones, r.Diff)
+	}
+	return r, nil
+}
+
+// Push applies the changes from Plan, and records what happened to
+// each zone in the result's Report.  It refuses to push changes that
+// exceed the safety limits unless Force is set.  Unless every zone
+// failed, the state file is updated afterwards.  If any zone failed,
+// then an error is returned; check Report.Status to see whether other
+// zones succeeded.
+func (s *Syncer) Push(ctx context.Context, r *SyncResult) error {
+	if len(r.Warnings) > 0 && !s.Force {
+		return fmt.Errorf("Refusing to push changes that exceed safety limits: %v", r.Warnings[0])
+	}
+
+	err := s.providers.Apply(ctx, s.Config, r.Diff, r.Report)
+	if r.Report.Status == StatusFailed {
+		return err
+	}
+
+	if s.Config.Safety.StateFile != "" {
+		state := &State{IPAddressCount: r.Addresses, Updated: time.Now()}
+		err := state.Save(s.Config.Safety.StateFile)
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// Sync runs Plan and then Push, and records the outcome in the sync
+// metrics.  The result is returned even if the push fails, as long as
+// Plan succeeded.
+func (s *Syncer) Sync(ctx context.Context) (*SyncResult, error) {
+	r, err := s.Plan(ctx)
+	if err == nil {
+		err = s.Push(ctx, r)
+	}
+	switch {
+	case err == nil:
+		syncRuns.WithLabelValues(StatusOK).Inc()
+		syncLastSuccess.SetToCurrentTime()
+	case r != nil && r.Report.Status == StatusPartial:
+		syncRuns.WithLabelValues(StatusPartial).Inc()
+	default:
+		syncRuns.WithLabelValues(StatusFailed).Inc()
+	}
+	return r, err
+}
+
+// SyncChanges runs PlanChanges and then Push.
+func (s *Syncer) SyncChanges(ctx context.Context, cs *ChangeSet) (*SyncResult, error) {
+	r, err := s.PlanChanges(ctx, cs)
+	if err != nil {
+		return nil, err
+	}
+	return r, s.Push(ctx, r)
+}
+
+// ApplyPlan checks that a saved Plan still matches DNS, and then pushes
+// exactly the changes in it.  Netbox isn't consulted.  Zones that
+// can't be imported are skipped and marked as failed in the returned
+// Report.  If any zone failed, then an error is returned too.
+func (s *Syncer) ApplyPlan(ctx context.Context, p *Plan) (*Report, error) {
+	report := NewReport(s.Config)
+	imported, importErrs, err := s.importZones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.AddZoneErrors(importErrs)
+
+	p = p.without(importErrs)
+	err = p.Check(imported)
+	if err != nil {
+		return nil, fmt.Errorf("Refusing to apply plan: %v; run plan again", err)
+	}
+	return report, s.providers.Apply(ctx, s.Config, p.Diff, report)
+}
+
+// importZones imports every zone.  Zones that fail are logged and
+// returned in a ZoneErrors; any other error is returned as err.
+func (s *Syncer) importZones(ctx context.Context) (*Zones, ZoneErrors, error) {
+	imported, err := s.providers.ImportZones(ctx, s.Config)
+	var ze ZoneErrors
+	if errors.As(err, &ze) {
+		for k, e := range ze {
+			log.Errorf("Skipping zone %q: %v", k, e)
+		}
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("Unable to import existing zones: %v", err)
+	}
+	return imported, ze, nil
+}
@@ -0,0 +1,268 @@
+package netbox2dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+)
+
+// webhookMaxBody is the largest webhook payload that WebhookHandler
+// accepts.
+const webhookMaxBody = 1 << 20
+
+// WebhookEvent is the part of a Netbox webhook payload that netbox2dns
+// uses.  See "Webhooks" in the Netbox documentation for the full
+// format.
+type WebhookEvent struct {
+	Event     string         `json:"event"` // "created", "updated", or "deleted"
+	Model     string         `json:"model"` // "ipaddress" for IP addresses
+	Data      *webhookIPAddr `json:"data"`
+	Snapshots struct {
+		Prechange  *webhookIPAddr `json:"prechange"`
+		Postchange *webhookIPAddr `json:"postchange"`
+	} `json:"snapshots"`
+}
+
+// webhookIPAddr holds the fields of an IP address in a webhook payload
+// that identify its DNS records.  Snapshots only contain raw field
+// values, so nothing else can be relied on.
+type webhookIPAddr struct {
+	Address string `json:"address"`
+	DNSName string `json:"dns_name"`
+}
+
+// ParseWebhook parses a Netbox webhook payload.
+func ParseWebhook(body []byte) (*WebhookEvent, error) {
+	e := &WebhookEvent{}
+	err := json.Unmarshal(body, e)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse webhook: %v", err)
+	}
+	return e, nil
+}
+
+// CheckWebhookSignature checks a webhook's `X-Hook-Signature` header,
+// which Netbox sets to the hex-encoded HMAC-SHA512 of the body, keyed
+// with the webhook's secret.
+func CheckWebhookSignature(secret string, body []byte, signature string) error {
+	if signature == "" {
+		return fmt.Errorf("Webhook isn't signed")
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("Invalid webhook signature: %v", err)
+	}
+	mac := hmac.New(sha512.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return fmt.Errorf("Webhook signature doesn't match")
+	}
+	return nil
+}
+
+// ChangeSet is a set of IP addresses and DNS names that have changed
+// in Netbox.  Syncer.PlanChanges only changes DNS records for these.
+type ChangeSet struct {
+	Addrs map[netip.Addr]bool
+	Names map[string]bool // Lower case, with a trailing dot
+}
+
+// NewChangeSet creates an empty ChangeSet.
+func NewChangeSet() *ChangeSet {
+	return &ChangeSet{
+		Addrs: make(map[netip.Addr]bool),
+		Names: make(map[string]bool),
+	}
+}
+
+// Empty returns true if the ChangeSet has no addresses or names.
+func (cs *ChangeSet) Empty() bool {
+	return len(cs.Addrs) == 0 && len(cs.Names) == 0
+}
+
+// AddEvent adds the addresses and names from an `ipaddress` webhook
+// event, both before and after the change.  Events for other models
+// are ignored.
+func (cs *ChangeSet) AddEvent(e *WebhookEvent) error {
+	if e.Model != "ipaddress" {
+		return nil
+	}
+	for _, ip := range []*webhookIPAddr{e.Data, e.Snapshots.Prechange, e.Snapshots.Postchange} {
+		if ip == nil {
+			continue
+		}
+		if ip.Address != "" {
+			prefix, err := netip.ParsePrefix(ip.Address)
+			if err != nil {
+				return fmt.Errorf("Invalid address %q in webhook: %v", ip.Address, err)
+			}
+			cs.Addrs[prefix.Addr()] = true
+		}
+		if ip.DNSName != "" {
+			cs.Names[strings.ToLower(strings.TrimSuffix(ip.DNSName, "."))+"."] = true
+		}
+	}
+	return nil
+}
+
+// Merge adds every address and name from other.
+func (cs *ChangeSet) Merge(other *ChangeSet) {
+	for a := range other.Addrs {
+		cs.Addrs[a] = true
+	}
+	for n := range other.Names {
+		cs.Names[n] = true
+	}
+}
+
+// restrictDelta removes changes from zd that don't touch one of the
+// changed addresses or names.  A name is affected if it's one of the
+// changed names, the PTR name of a changed address, or if it has an A
+// or AAAA record for a changed address in either version of the
+// zone.  CNAMEs that point at an affected name, and registry TXT
+// records for affected names, are affected too.
+func (cs *ChangeSet) restrictDelta(older, newer *Zone, registry *Registry, zd *ZoneDelta) {
+	affected := make(map[string]bool)
+	for n := range cs.Names {
+		affected[n] = true
+	}
+	for a := range cs.Addrs {
+		affected[ReverseName(a)] = true
+	}
+	for _, zone := range []*Zone{older, newer} {
+		for name, records := range zone.Records {
+			for _, r := range records {
+				if r.Type != "A" && r.Type != "AAAA" {
+					continue
+				}
+				for _, rrdata := range r.Rrdatas {
+					if a, err := netip.ParseAddr(rrdata); err == nil && cs.Addrs[a] {
+						affected[strings.ToLower(name)] = true
+					}
+				}
+			}
+		}
+	}
+	for _, zone := range []*Zone{older, newer} {
+		for name, records := range zone.Records {
+			for _, r := range records {
+				if r.Type == "CNAME" && len(r.Rrdatas) > 0 && affected[strings.ToLower(r.Rrdatas[0])] {
+					affected[strings.ToLower(name)] = true
+				}
+			}
+		}
+	}
+
+	isAffected := func(name string) bool {
+		name = strings.ToLower(name)
+		if affected[name] {
+			return true
+		}
+		if registry != nil {
+			if n, ok := strings.CutPrefix(name, strings.ToLower(registry.Prefix)); ok {
+				return affected[n]
+			}
+		}
+		return false
+	}
+	for name := range zd.AddRecords {
+		if !isAffected(name) {
+			delete(zd.AddRecords, name)
+		}
+	}
+	for name := range zd.RemoveRecords {
+		if !isAffected(name) {
+			delete(zd.RemoveRecords, name)
+		}
+	}
+}
+
+// WebhookHandler is an http.Handler that receives Netbox webhooks for
+// IP addresses.  Changes are collected until Take is called, so a
+// burst of webhooks can be handled in one go.
+type WebhookHandler struct {
+	secret  string
+	mu      sync.Mutex
+	pending *ChangeSet
+	ready   chan struct{}
+}
+
+// NewWebhookHandler creates a WebhookHandler that only accepts
+// webhooks signed with secret.
+func NewWebhookHandler(secret string) *WebhookHandler {
+	return &WebhookHandler{
+		secret:  secret,
+		pending: NewChangeSet(),
+		ready:   make(chan struct{}, 1),
+	}
+}
+
+// Ready returns a channel that receives a value when there are
+// changes waiting to be taken.
+func (h *WebhookHandler) Ready() <-chan struct{} {
+	return h.ready
+}
+
+// Take returns the changes received since the last call to Take.
+func (h *WebhookHandler) Take() *ChangeSet {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cs := h.pending
+	h.pending = NewChangeSet()
+	return cs
+}
+
+// ServeHTTP handles a single webhook.
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, webhookMaxBody))
+	if err != nil {
+		http.Error(w, "Unable to read body", http.StatusBadRequest)
+		return
+	}
+	err = CheckWebhookSignature(h.secret, body, r.Header.Get("X-Hook-Signature"))
+	if err != nil {
+		log.Warningf("Rejected webhook from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+	e, err := ParseWebhook(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cs := NewChangeSet()
+	err = cs.AddEvent(e)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if cs.Empty() {
+		log.V(1).Infof("Ignoring webhook for %q %q", e.Model, e.Event)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	log.Infof("Received webhook for %s %s", e.Model, e.Event)
+
+	h.mu.Lock()
+	h.pending.Merge(cs)
+	h.mu.Unlock()
+	select {
+	case h.ready <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,130 @@
+package netbox2dns
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testWebhook is a Netbox webhook for an IP address that was renamed
+// from old.example.com to new.example.com.
+const testWebhook = `{
+  "event": "updated",
+  "model": "ipaddress",
+  "data": {"id": 1, "address": "10.0.0.1/24", "dns_name": "new.example.com", "status": {"value": "active"}},
+  "snapshots": {
+    "prechange": {"address": "10.0.0.1/24", "dns_name": "old.example.com"},
+    "postchange": {"address": "10.0.0.1/24", "dns_name": "new.example.com"}
+  }
+}`
+
+func signWebhook(secret, body string) string {
+	mac := hmac.New(sha512.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestCheckWebhookSignature(t *testing.T) {
+	body := []byte(testWebhook)
+	if err := CheckWebhookSignature("secret", body, signWebhook("secret", testWebhook)); err != nil {
+		t.Errorf("CheckWebhookSignature() failed on a valid signature: %v", err)
+	}
+	for _, sig := range []string{"", "not hex", signWebhook("wrong", testWebhook)} {
+		if err := CheckWebhookSignature("secret", body, sig); err == nil {
+			t.Errorf("CheckWebhookSignature() accepted signature %q", sig)
+		}
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	h := NewWebhookHandler("secret")
+
+	tests := []struct {
+		name   string
+		body   string
+		secret string
+		want   int
+	}{
+		{"valid", testWebhook, "secret", http.StatusAccepted},
+		{"bad signature", testWebhook, "wrong", http.StatusForbidden},
+		{"other model", `{"event": "created", "model": "device", "data": {"id": 1}}`, "secret", http.StatusNoContent},
+		{"bad json", `{`, "secret", http.StatusBadRequest},
+		{"bad address", `{"event": "created", "model": "ipaddress", "data": {"address": "bogus"}}`, "secret", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(test.body))
+		req.Header.Set("X-Hook-Signature", signWebhook(test.secret, test.body))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != test.want {
+			t.Errorf("%s: got status %d want %d", test.name, w.Code, test.want)
+		}
+	}
+
+	select {
+	case <-h.Ready():
+	default:
+		t.Fatalf("Ready() not signaled after a valid webhook")
+	}
+	cs := h.Take()
+	if !cs.Addrs[netip.MustParseAddr("10.0.0.1")] || len(cs.Addrs) != 1 {
+		t.Errorf("Take().Addrs wrong; got %v", cs.Addrs)
+	}
+	if !cs.Names["old.example.com."] || !cs.Names["new.example.com."] || len(cs.Names) != 2 {
+		t.Errorf("Take().Names wrong; got %v", cs.Names)
+	}
+	if !h.Take().Empty() {
+		t.Errorf("Take() didn't clear pending changes")
+	}
+}
+
+func TestChangeSetRestrictDelta(t *testing.T) {
+	reg := &Registry{OwnerID: "test", Prefix: "_netbox2dns."}
+
+	older := &Zone{Name: "example.com", DeleteEntries: true, Records: make(map[string][]*Record)}
+	for _, r := range []*Record{
+		{Name: "old.example.com.", Type: "A", Rrdatas: []string{"10.0.0.1"}},
+		{Name: "_netbox2dns.old.example.com.", Type: "TXT", Rrdatas: []string{reg.TXTValue()}},
+		{Name: "gen.example.com.", Type: "A", Rrdatas: []string{"10.0.0.2"}},
+		{Name: "alias.example.com.", Type: "CNAME", Rrdatas: []string{"gen.example.com."}},
+		{Name: "stale.example.com.", Type: "A", Rrdatas: []string{"10.0.0.9"}},
+	} {
+		older.AddRecord(r)
+	}
+	newer := &Zone{Name: "example.com", Records: make(map[string][]*Record)}
+	for _, r := range []*Record{
+		{Name: "new.example.com.", Type: "A", Rrdatas: []string{"10.0.0.1"}},
+		{Name: "gen2.example.com.", Type: "A", Rrdatas: []string{"10.0.0.2"}},
+		{Name: "alias.example.com.", Type: "CNAME", Rrdatas: []string{"gen2.example.com."}},
+		{Name: "unrelated.example.com.", Type: "A", Rrdatas: []string{"10.0.0.3"}},
+	} {
+		newer.AddRecord(r)
+	}
+
+	zd := older.NewZoneDelta()
+	older.Compare(newer, zd)
+
+	cs := NewChangeSet()
+	cs.Names["old.example.com."] = true
+	cs.Addrs[netip.MustParseAddr("10.0.0.2")] = true
+	cs.restrictDelta(older, newer, reg, zd)
+
+	got := []string{}
+	for name := range zd.AddRecords {
+		got = append(got, "+"+name)
+	}
+	for name := range zd.RemoveRecords {
+		got = append(got, "-"+name)
+	}
+	sort.Strings(got)
+	want := "+alias.example.com. +gen2.example.com. -_netbox2dns.old.example.com. -alias.example.com. -gen.example.com. -old.example.com."
+	if strings.Join(got, " ") != want {
+		t.Errorf("restrictDelta() wrong;\n got %v\nwant %v", strings.Join(got, " "), want)
+	}
+}
@@ -1,106 +1,505 @@
 package netbox2dns
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 
-	"github.com/shuLhan/share/lib/dns"
+	log "github.com/golang/glog"
+	"github.com/miekg/dns"
+)
+
+// Markers for the block of a zone file that netbox2dns owns when
+// `managed_block` is set.
+const (
+	blockBegin = "; BEGIN netbox2dns"
+	blockEnd   = "; END netbox2dns"
 )
 
 // ZoneFileDNS provides an implementation of DNS using traditional
-// BIND-style zone files.
+// BIND-style zone files.  Any standard record type can appear in the
+// zone file; records that netbox2dns doesn't manage are read and
+// written back out unchanged.
+//
+// By default, Save() rewrites the whole zone file.  If the zone has
+// `managed_block` set, then netbox2dns only edits the records between
+// the `; BEGIN netbox2dns` and `; END netbox2dns` markers, and
+// everything outside of the markers is left alone, except for the
+// SOA serial number.
 type ZoneFileDNS struct {
-	zone *dns.Zone
+	filename string
+	origin   string
+	records  []dns.RR
+	managed  *Managed // Records that may be removed
+
+	// These are only used when managedBlock is true.
+	managedBlock bool
+	text         []byte   // The original contents of the zone file
+	blockStart   int      // Offset of the first byte inside the block
+	blockEnd     int      // Offset of the END marker
+	blockFound   bool     // False if the file has no markers yet
+	block        []dns.RR // Records inside the block
 }
 
 // NewZoneFileDNS creates a new ZoneFileDNS object.
 func NewZoneFileDNS(ctx context.Context, cz *ConfigZone) (*ZoneFileDNS, error) {
-	zone, err := dns.ParseZoneFile(cz.Filename, cz.Name, uint32(cz.TTL))
+	zfd := &ZoneFileDNS{
+		filename:     cz.Filename,
+		origin:       dns.Fqdn(cz.Name),
+		managedBlock: cz.ManagedBlock,
+		managed:      DefaultManaged(),
+	}
+
+	err := zfd.load(cz)
 	if err != nil {
 		return nil, err
 	}
+	return zfd, nil
+}
 
-	zfd := &ZoneFileDNS{
-		zone: zone,
+// setManaged sets the records that RemoveRecord may remove.
+func (zfd *ZoneFileDNS) setManaged(m *Managed) {
+	zfd.managed = m
+}
+
+// load reads and parses the zone file, replacing any records that were
+// read earlier.
+func (zfd *ZoneFileDNS) load(cz *ConfigZone) error {
+	text, err := os.ReadFile(zfd.filename)
+	if err != nil {
+		return err
 	}
 
-	return zfd, nil
+	zfd.records, err = zfd.parse(text, cz)
+	if err != nil {
+		return err
+	}
+	if soa := zfd.soa(); soa != nil {
+		zoneSOASerial.WithLabelValues(cz.Key()).Set(float64(soa.Serial))
+	}
+
+	zfd.text, zfd.block = nil, nil
+	zfd.blockStart, zfd.blockEnd, zfd.blockFound = 0, 0, false
+	if zfd.managedBlock {
+		zfd.text = text
+		zfd.blockStart, zfd.blockEnd, zfd.blockFound, err = findBlock(text)
+		if err != nil {
+			return fmt.Errorf("Unable to find netbox2dns block in %q: %v", zfd.filename, err)
+		}
+		if zfd.blockFound {
+			zfd.block, err = zfd.blockRecords(text, cz)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parse parses zone file text into a list of dns.RRs.
+func (zfd *ZoneFileDNS) parse(text []byte, cz *ConfigZone) ([]dns.RR, error) {
+	records := []dns.RR{}
+
+	zp := dns.NewZoneParser(bytes.NewReader(text), zfd.origin, cz.Filename)
+	zp.SetDefaultTTL(uint32(cz.TTL))
+	zp.SetIncludeAllowed(true)
+
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		records = append(records, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to parse zone file %q: %v", cz.Filename, err)
+	}
+
+	return records, nil
+}
+
+// blockRecords returns the records from zfd.records that are inside
+// of the netbox2dns block.  The block can't be parsed on its own,
+// because it depends on any $ORIGIN, $TTL, and owner name that come
+// before it.  ZoneParser doesn't say where each record came from, so
+// the text up to each marker is parsed to find out how many records
+// come before the block, and how many are in it.
+func (zfd *ZoneFileDNS) blockRecords(text []byte, cz *ConfigZone) ([]dns.RR, error) {
+	before, err := zfd.parse(text[:zfd.blockStart], cz)
+	if err != nil {
+		return nil, err
+	}
+	through, err := zfd.parse(text[:zfd.blockEnd], cz)
+	if err != nil {
+		return nil, err
+	}
+	if len(through) > len(zfd.records) {
+		return nil, fmt.Errorf("Unable to find netbox2dns block records in %q", zfd.filename)
+	}
+	return slices.Clone(zfd.records[len(before):len(through)]), nil
+}
+
+// findBlock finds the netbox2dns-owned block in a zone file.  It
+// returns the offset of the first byte after the BEGIN marker line and
+// the offset of the start of the END marker line.  If neither marker
+// is present, then `found` is false.
+func findBlock(text []byte) (start, end int, found bool, err error) {
+	start, end = -1, -1
+	offset := 0
+	for _, line := range bytes.SplitAfter(text, []byte("\n")) {
+		switch string(bytes.TrimSpace(line)) {
+		case blockBegin:
+			if start != -1 {
+				return 0, 0, false, fmt.Errorf("more than one %q marker", blockBegin)
+			}
+			start = offset + len(line)
+		case blockEnd:
+			if end != -1 {
+				return 0, 0, false, fmt.Errorf("more than one %q marker", blockEnd)
+			}
+			end = offset
+		}
+		offset += len(line)
+	}
+
+	switch {
+	case start == -1 && end == -1:
+		return 0, 0, false, nil
+	case start == -1:
+		return 0, 0, false, fmt.Errorf("%q without %q", blockEnd, blockBegin)
+	case end == -1:
+		return 0, 0, false, fmt.Errorf("%q without %q", blockBegin, blockEnd)
+	case end < start:
+		return 0, 0, false, fmt.Errorf("%q before %q", blockEnd, blockBegin)
+	}
+	return start, end, true, nil
 }
 
 // ImportZone reads DNS entries from a zone file on disk (as specified
 // as part of the zone config in the netbox2dns config file) and
-// populates the ZoneFileDNS with them.
-func (zfd *ZoneFileDNS) ImportZone(cz *ConfigZone) (*Zone, error) {
+// populates the ZoneFileDNS with them.  The file is re-read each time,
+// so a ZoneFileDNS can be reused to pick up changes made by hand.
+//
+// In `managed_block` mode, managed records outside of the netbox2dns
+// block are left out of the Zone.  netbox2dns can't remove them, so
+// including them would make `delete_entries` try, and fail, to remove
+// them on every run.
+func (zfd *ZoneFileDNS) ImportZone(ctx context.Context, cz *ConfigZone) (*Zone, error) {
+	err := zfd.load(cz)
+	if err != nil {
+		return nil, err
+	}
+
 	zone := &Zone{
 		Name:          cz.Name,
 		Filename:      cz.Filename,
 		TTL:           cz.TTL,
 		DeleteEntries: cz.DeleteEntries,
+		IgnoreTTL:     cz.IgnoreTTL,
 		Records:       make(map[string][]*Record),
 	}
 
-	for _, i := range zfd.zone.Records {
-		for _, entry := range i {
-			r := Record{
-				Name: strings.TrimRight(entry.Name, ".") + ".",
-				Type: dns.RecordTypeNames[entry.Type],
-				TTL:  int64(entry.TTL),
-			}
-
-			s := entry.Value.(string)
-			r.Rrdatas = []string{strings.TrimRight(s, ".") + "."}
-
-			zone.AddRecord(&r)
+	for _, rr := range zfd.records {
+		r := recordFromRR(rr)
+		if zfd.managedBlock && r.IsManaged(zfd.managed) && !zfd.inBlock(rr) {
+			continue
 		}
+		zone.AddRecord(r)
 	}
 
 	return zone, nil
 }
 
-// rrFromRecord creates a DNS ResourceRecord from a netbox2dns Record.
-func (zfd *ZoneFileDNS) rrFromRecord(cz *ConfigZone, r *Record) *dns.ResourceRecord {
-	return &dns.ResourceRecord{
-		Name:  r.NameNoDot(),
-		Type:  dns.RecordTypes[r.Type],
-		Class: dns.RecordClassIN,
-		TTL:   uint32(r.TTL),
-		Value: r.RrdataNoDot(),
+// inBlock returns true if rr is inside of the netbox2dns block.
+func (zfd *ZoneFileDNS) inBlock(rr dns.RR) bool {
+	for _, b := range zfd.block {
+		if dns.IsDuplicate(b, rr) {
+			return true
+		}
 	}
+	return false
 }
 
 // WriteRecord writes a Record to the zonefile behind the ZoneFileDNS.
 // Note that this won't actually be written until 'Save()' is called.
-func (zfd *ZoneFileDNS) WriteRecord(cz *ConfigZone, r *Record) error {
-	entry := zfd.rrFromRecord(cz, r)
-
-	err := zfd.zone.Add(entry)
+func (zfd *ZoneFileDNS) WriteRecord(ctx context.Context, cz *ConfigZone, r *Record) error {
+	rrs, err := rrsFromRecord(r)
 	if err != nil {
 		return err
 	}
 
+	for _, rr := range rrs {
+		zfd.records = addRR(zfd.records, rr)
+		if zfd.managedBlock {
+			zfd.block = addRR(zfd.block, rr)
+		}
+	}
 	return nil
 }
 
-// RemoveRecord removes a Record from the zonefile behind the ZoneFileDNS.
-// Note that this won't actually be written until 'Save()' is called.
-func (zfd *ZoneFileDNS) RemoveRecord(cz *ConfigZone, r *Record) error {
-	entry := zfd.rrFromRecord(cz, r)
+// addRR adds rr to records, unless an identical record is already
+// present.  In that case, the existing record's TTL is updated.
+func addRR(records []dns.RR, rr dns.RR) []dns.RR {
+	for _, old := range records {
+		if dns.IsDuplicate(old, rr) {
+			old.Header().Ttl = rr.Header().Ttl
+			return records
+		}
+	}
+	return append(records, dns.Copy(rr))
+}
+
+// RemoveRecord removes a Record from the zonefile behind the
+// ZoneFileDNS.  Only record types that netbox2dns manages can be
+// removed, and in `managed_block` mode only records inside of the
+// netbox2dns block can be removed.  Note that this won't actually be
+// written until 'Save()' is called.
+func (zfd *ZoneFileDNS) RemoveRecord(ctx context.Context, cz *ConfigZone, r *Record) error {
+	if !r.IsManaged(zfd.managed) {
+		return fmt.Errorf("Refusing to remove %s record for %q; netbox2dns does not manage %s records", r.Type, r.Name, r.Type)
+	}
 
-	err := zfd.zone.Remove(entry)
+	rrs, err := rrsFromRecord(r)
 	if err != nil {
 		return err
 	}
+
+	if zfd.managedBlock {
+		block, removed := removeRRs(zfd.block, rrs)
+		if removed != len(rrs) {
+			return fmt.Errorf("Refusing to remove %s record for %q; it is outside of the netbox2dns block", r.Type, r.Name)
+		}
+		zfd.block = block
+	}
+	zfd.records, _ = removeRRs(zfd.records, rrs)
+	return nil
+}
+
+// removeRRs removes every record in rrs from records, and returns
+// the new list of records along with the number of records removed.
+func removeRRs(records []dns.RR, rrs []dns.RR) ([]dns.RR, int) {
+	result := []dns.RR{}
+	removed := 0
+	for _, old := range records {
+		remove := false
+		for _, rr := range rrs {
+			if dns.IsDuplicate(old, rr) {
+				remove = true
+			}
+		}
+		if remove {
+			removed++
+		} else {
+			result = append(result, old)
+		}
+	}
+	return result, removed
+}
+
+// soa returns the zone's SOA record, or nil if there isn't one.
+func (zfd *ZoneFileDNS) soa() *dns.SOA {
+	for _, rr := range zfd.records {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa
+		}
+	}
 	return nil
 }
 
 // Save flushes the current zonefile to disk.  Without this, no
 // changes will be written out.
-func (zfd *ZoneFileDNS) Save(cz *ConfigZone) error {
-	newserial, err := IncrementSerial(cz, zfd.zone.SOA.Serial)
+//
+// The zone is written with the SOA first, then the rest of the
+// records at the zone apex, then all other records sorted by name.
+// The new file is written next to the old one and then renamed into
+// place, so a failed write won't leave a truncated zone file behind.
+func (zfd *ZoneFileDNS) Save(ctx context.Context, cz *ConfigZone) error {
+	soa := zfd.soa()
+	if soa == nil {
+		return fmt.Errorf("Zone file %q has no SOA record", zfd.filename)
+	}
+	newserial, err := IncrementSerial(cz, soa.Serial)
+	if err != nil {
+		return err
+	}
+	oldserial := soa.Serial
+	soa.Serial = newserial
+
+	if zfd.managedBlock {
+		err = zfd.saveBlock(oldserial, newserial)
+	} else {
+		err = zfd.saveZone(soa)
+	}
+	if err != nil {
+		return err
+	}
+	zoneSOASerial.WithLabelValues(cz.Key()).Set(float64(newserial))
+	return nil
+}
+
+// saveZone writes out the whole zone, with soa first.
+func (zfd *ZoneFileDNS) saveZone(soa *dns.SOA) error {
+
+	records := []dns.RR{soa}
+	for _, rr := range zfd.records {
+		if rr != dns.RR(soa) {
+			records = append(records, rr)
+		}
+	}
+	rest := records[1:]
+	sort.SliceStable(rest, func(i, j int) bool {
+		a, b := rest[i].Header().Name, rest[j].Header().Name
+		if a == zfd.origin || b == zfd.origin {
+			return a == zfd.origin && b != zfd.origin
+		}
+		return a < b
+	})
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "$ORIGIN %s\n", zfd.origin)
+	for _, rr := range records {
+		fmt.Fprintln(b, rr.String())
+	}
+
+	return writeFileAtomic(zfd.filename, []byte(b.String()))
+}
+
+// saveBlock writes the zone file in `managed_block` mode.  Only the
+// text between the netbox2dns markers is replaced, plus the SOA serial
+// number.  If the file doesn't have markers yet, then a new block is
+// appended to the end of the file.
+func (zfd *ZoneFileDNS) saveBlock(oldserial, newserial uint32) error {
+	var before, after []byte
+	if zfd.blockFound {
+		before = zfd.text[:zfd.blockStart]
+		after = zfd.text[zfd.blockEnd:]
+	} else {
+		log.Infof("Adding new netbox2dns block to the end of %q", zfd.filename)
+		before = zfd.text
+		if len(before) > 0 && before[len(before)-1] != '\n' {
+			before = append(before, '\n')
+		}
+		before = append(before, []byte(blockBegin+"\n")...)
+		after = []byte(blockEnd + "\n")
+	}
+
+	// The SOA is almost always outside of the block, but could
+	// be in an $INCLUDEd file, where we can't update it.
+	var ok bool
+	before, ok = replaceSerial(before, oldserial, newserial)
+	if !ok {
+		after, ok = replaceSerial(after, oldserial, newserial)
+	}
+	if !ok {
+		log.Warningf("Unable to find SOA serial %d in %q; serial number not updated", oldserial, zfd.filename)
+	}
+
+	records := append([]dns.RR{}, zfd.block...)
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Header().Name < records[j].Header().Name
+	})
+
+	b := &bytes.Buffer{}
+	b.Write(before)
+	for _, rr := range records {
+		fmt.Fprintln(b, rr.String())
+	}
+	b.Write(after)
+
+	return writeFileAtomic(zfd.filename, b.Bytes())
+}
+
+// replaceSerial finds the SOA record in zone file text and replaces
+// its serial number, leaving everything else, including comments and
+// whitespace, unchanged.  It returns false if no SOA record with the
+// old serial number was found.
+func replaceSerial(text []byte, oldserial, newserial uint32) ([]byte, bool) {
+	tokens := zoneTokens(text)
+	for i, t := range tokens {
+		if !strings.EqualFold(string(text[t[0]:t[1]]), "SOA") || i+3 >= len(tokens) {
+			continue
+		}
+		// SOA is followed by MNAME, RNAME, and then SERIAL.
+		s := tokens[i+3]
+		serial, err := strconv.ParseUint(string(text[s[0]:s[1]]), 10, 32)
+		if err != nil || uint32(serial) != oldserial {
+			continue
+		}
+		result := append([]byte{}, text[:s[0]]...)
+		result = append(result, []byte(strconv.FormatUint(uint64(newserial), 10))...)
+		return append(result, text[s[1]:]...), true
+	}
+	return text, false
+}
+
+// zoneTokens splits zone file text into tokens, and returns the start
+// and end offset of each token.  Comments, parentheses, and quoted
+// strings are skipped.
+func zoneTokens(text []byte) [][2]int {
+	tokens := [][2]int{}
+	start := -1
+	end := func(i int) {
+		if start != -1 {
+			tokens = append(tokens, [2]int{start, i})
+			start = -1
+		}
+	}
+
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; c {
+		case ';':
+			end(i)
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case '"':
+			end(i)
+			for i++; i < len(text) && text[i] != '"'; i++ {
+				if text[i] == '\\' {
+					i++
+				}
+			}
+		case ' ', '\t', '\r', '\n', '(', ')':
+			end(i)
+		default:
+			if start == -1 {
+				start = i
+			}
+		}
+	}
+	end(len(text))
+
+	return tokens
+}
+
+// writeFileAtomic writes data to a temporary file in the same
+// directory as filename and then renames it over filename.  The
+// original file's permissions are preserved.
+func writeFileAtomic(filename string, data []byte) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(filename); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
 	if err != nil {
 		return err
 	}
-	zfd.zone.SOA.Serial = newserial
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
 
-	return zfd.zone.Save()
+	return os.Rename(f.Name(), filename)
 }
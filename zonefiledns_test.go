@@ -0,0 +1,329 @@
+package netbox2dns
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// copyZoneFile copies a zone file from testdata into a temporary
+// directory, so tests can modify it.
+func copyZoneFile(t *testing.T, name string) string {
+	return copyZoneFileTo(t, name, t.TempDir())
+}
+
+func copyZoneFileTo(t *testing.T, name, dir string) string {
+	b, err := os.ReadFile(filepath.Join("testdata/zonefile", name))
+	if err != nil {
+		t.Fatalf("Unable to read zone file: %v", err)
+	}
+	filename := filepath.Join(dir, name)
+	err = os.WriteFile(filename, b, 0644)
+	if err != nil {
+		t.Fatalf("Unable to write zone file: %v", err)
+	}
+	return filename
+}
+
+func findRecord(zone *Zone, name, rtype string) *Record {
+	for _, r := range zone.Records[name] {
+		if r.Type == rtype {
+			return r
+		}
+	}
+	return nil
+}
+
+func TestZoneFileAllTypes(t *testing.T) {
+	cz := &ConfigZone{
+		ZoneType: "zonefile",
+		Name:     "example.com",
+		Filename: copyZoneFile(t, "example.com.zone"),
+		TTL:      300,
+	}
+
+	p, err := NewDNSProvider(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("NewDNSProvider() returned error: %v", err)
+	}
+	zone, err := p.ImportZone(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("ImportZone() returned error: %v", err)
+	}
+
+	want := map[string][]string{
+		"example.com.":           {"SOA", "NS", "MX", "TXT", "CAA"},
+		"_sip._tcp.example.com.": {"SRV"},
+		"router1.example.com.":   {"A", "AAAA"},
+		"www.example.com.":       {"CNAME"},
+	}
+	for name, types := range want {
+		for _, rtype := range types {
+			if findRecord(zone, name, rtype) == nil {
+				t.Errorf("ImportZone(): missing %s record for %q", rtype, name)
+			}
+		}
+	}
+	if r := findRecord(zone, "example.com.", "MX"); r == nil || r.Rrdatas[0] != "10 mail.example.com." {
+		t.Errorf("ImportZone(): wrong MX record: %+v", r)
+	}
+
+	err = p.RemoveRecord(context.Background(), cz, &Record{Name: "example.com.", Type: "MX", TTL: 3600, Rrdatas: []string{"10 mail.example.com."}})
+	if err == nil {
+		t.Errorf("RemoveRecord() of an MX record should have failed")
+	}
+	err = p.RemoveRecord(context.Background(), cz, &Record{Name: "router1.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"192.0.2.20"}})
+	if err != nil {
+		t.Fatalf("RemoveRecord() returned error: %v", err)
+	}
+	err = p.WriteRecord(context.Background(), cz, &Record{Name: "router2.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"192.0.2.21"}})
+	if err != nil {
+		t.Fatalf("WriteRecord() returned error: %v", err)
+	}
+	err = p.Save(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("Save() returned error: %v", err)
+	}
+
+	// Read the zone back in and make sure that everything survived.
+	p, err = NewDNSProvider(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("NewDNSProvider() returned error on saved zone: %v", err)
+	}
+	zone, err = p.ImportZone(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("ImportZone() returned error on saved zone: %v", err)
+	}
+	for name, types := range want {
+		for _, rtype := range types {
+			if name == "router1.example.com." && rtype == "A" {
+				continue
+			}
+			if findRecord(zone, name, rtype) == nil {
+				t.Errorf("Saved zone: missing %s record for %q", rtype, name)
+			}
+		}
+	}
+	if r := findRecord(zone, "router1.example.com.", "A"); r != nil {
+		t.Errorf("Saved zone: router1.example.com. A should have been removed, got %+v", r)
+	}
+	if r := findRecord(zone, "router2.example.com.", "A"); r == nil || r.Rrdatas[0] != "192.0.2.21" {
+		t.Errorf("Saved zone: router2.example.com. A wrong, got %+v", r)
+	}
+	if r := findRecord(zone, "example.com.", "SOA"); r == nil || r.Rrdatas[0] == "ns1.example.com. hostmaster.example.com. 2022123004 3600 600 86400 300" {
+		t.Errorf("Saved zone: SOA serial was not incremented: %+v", r)
+	}
+}
+
+func TestZoneFileManagedBlock(t *testing.T) {
+	filename := copyZoneFile(t, "block.example.com.zone")
+	copyZoneFileTo(t, "block.include.zone", filepath.Dir(filename))
+
+	original, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Unable to read zone file: %v", err)
+	}
+
+	cz := &ConfigZone{
+		ZoneType:     "zonefile",
+		Name:         "example.com",
+		Filename:     filename,
+		TTL:          300,
+		ManagedBlock: true,
+	}
+
+	p, err := NewDNSProvider(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("NewDNSProvider() returned error: %v", err)
+	}
+	zone, err := p.ImportZone(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("ImportZone() returned error: %v", err)
+	}
+	for _, name := range []string{"router1.example.com.", "router2.example.com."} {
+		if findRecord(zone, name, "A") == nil {
+			t.Errorf("ImportZone(): missing A record for %q", name)
+		}
+	}
+	// Managed records outside of the block are left out, so
+	// delete_entries doesn't try to remove them.
+	for _, name := range []string{"mail.example.com.", "ns1.example.com."} {
+		if r := findRecord(zone, name, "A"); r != nil {
+			t.Errorf("ImportZone(): got A record for %q outside of the block: %+v", name, r)
+		}
+	}
+	if findRecord(zone, "example.com.", "SOA") == nil {
+		t.Errorf("ImportZone(): missing SOA record")
+	}
+
+	err = p.RemoveRecord(context.Background(), cz, &Record{Name: "mail.example.com.", Type: "A", TTL: 3600, Rrdatas: []string{"192.0.2.10"}})
+	if err == nil {
+		t.Errorf("RemoveRecord() outside of the netbox2dns block should have failed")
+	}
+	err = p.RemoveRecord(context.Background(), cz, &Record{Name: "router2.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"192.0.2.21"}})
+	if err != nil {
+		t.Fatalf("RemoveRecord() returned error: %v", err)
+	}
+	err = p.WriteRecord(context.Background(), cz, &Record{Name: "router3.example.com.", Type: "AAAA", TTL: 300, Rrdatas: []string{"2001:db8::22"}})
+	if err != nil {
+		t.Fatalf("WriteRecord() returned error: %v", err)
+	}
+	err = p.Save(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("Save() returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Unable to read zone file: %v", err)
+	}
+
+	serial, _ := IncrementSerial(cz, 2022123004)
+	want := strings.Replace(string(original), "2022123004", strconv.FormatUint(uint64(serial), 10), 1)
+	want = strings.Replace(want,
+		"router1.example.com.\t300\tIN\tA\t192.0.2.20\nrouter2.example.com.\t300\tIN\tA\t192.0.2.21\n",
+		"router1.example.com.\t300\tIN\tA\t192.0.2.20\nrouter3.example.com.\t300\tIN\tAAAA\t2001:db8::22\n", 1)
+
+	if string(got) != want {
+		t.Errorf("Save() wrote the wrong zone file.\nGot:\n%s\nWant:\n%s", got, want)
+	}
+}
+
+func TestZoneFileManagedBlockDirectives(t *testing.T) {
+	// The block uses the $ORIGIN, $TTL, and owner name set before it.
+	text := `$ORIGIN example.com.
+$TTL 3600
+@	IN SOA	ns1 hostmaster 2022123004 3600 600 86400 300
+	IN NS	ns1
+ns1	IN A	192.0.2.1
+$ORIGIN lab.example.com.
+router1	IN A	10.0.0.1
+; BEGIN netbox2dns
+	IN AAAA	2001:db8::1
+host	IN A	10.0.0.2
+; END netbox2dns
+`
+	filename := filepath.Join(t.TempDir(), "lab.example.com.zone")
+	err := os.WriteFile(filename, []byte(text), 0644)
+	if err != nil {
+		t.Fatalf("Unable to write zone file: %v", err)
+	}
+
+	cz := &ConfigZone{
+		ZoneType:     "zonefile",
+		Name:         "example.com",
+		Filename:     filename,
+		TTL:          300,
+		ManagedBlock: true,
+	}
+
+	p, err := NewDNSProvider(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("NewDNSProvider() returned error: %v", err)
+	}
+	zone, err := p.ImportZone(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("ImportZone() returned error: %v", err)
+	}
+	if r := findRecord(zone, "host.lab.example.com.", "A"); r == nil || r.TTL != 3600 || r.Rrdatas[0] != "10.0.0.2" {
+		t.Errorf("ImportZone(): wrong A record for host.lab.example.com.: %+v", r)
+	}
+	if r := findRecord(zone, "router1.lab.example.com.", "AAAA"); r == nil || r.TTL != 3600 {
+		t.Errorf("ImportZone(): wrong AAAA record for router1.lab.example.com.: %+v", r)
+	}
+	if r := findRecord(zone, "router1.lab.example.com.", "A"); r != nil {
+		t.Errorf("ImportZone(): got A record for router1.lab.example.com. outside of the block: %+v", r)
+	}
+
+	err = p.WriteRecord(context.Background(), cz, &Record{Name: "new.lab.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.3"}})
+	if err != nil {
+		t.Fatalf("WriteRecord() returned error: %v", err)
+	}
+	err = p.Save(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("Save() returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Unable to read zone file: %v", err)
+	}
+	serial, _ := IncrementSerial(cz, 2022123004)
+	want := strings.Replace(text, "2022123004", strconv.FormatUint(uint64(serial), 10), 1)
+	want = strings.Replace(want,
+		"\tIN AAAA\t2001:db8::1\nhost\tIN A\t10.0.0.2\n",
+		"host.lab.example.com.\t3600\tIN\tA\t10.0.0.2\nnew.lab.example.com.\t300\tIN\tA\t10.0.0.3\nrouter1.lab.example.com.\t3600\tIN\tAAAA\t2001:db8::1\n", 1)
+	if string(got) != want {
+		t.Errorf("Save() wrote the wrong zone file.\nGot:\n%s\nWant:\n%s", got, want)
+	}
+}
+
+func TestZoneFileManagedBlockMissing(t *testing.T) {
+	filename := copyZoneFile(t, "example.com.zone")
+	original, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Unable to read zone file: %v", err)
+	}
+
+	cz := &ConfigZone{
+		ZoneType:     "zonefile",
+		Name:         "example.com",
+		Filename:     filename,
+		TTL:          300,
+		ManagedBlock: true,
+	}
+
+	p, err := NewDNSProvider(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("NewDNSProvider() returned error: %v", err)
+	}
+	err = p.WriteRecord(context.Background(), cz, &Record{Name: "router3.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"192.0.2.22"}})
+	if err != nil {
+		t.Fatalf("WriteRecord() returned error: %v", err)
+	}
+	err = p.Save(context.Background(), cz)
+	if err != nil {
+		t.Fatalf("Save() returned error: %v", err)
+	}
+
+	got, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Unable to read zone file: %v", err)
+	}
+	serial, _ := IncrementSerial(cz, 2022123004)
+	want := strings.Replace(string(original), "2022123004", strconv.FormatUint(uint64(serial), 10), 1) +
+		"; BEGIN netbox2dns\nrouter3.example.com.\t300\tIN\tA\t192.0.2.22\n; END netbox2dns\n"
+	if string(got) != want {
+		t.Errorf("Save() wrote the wrong zone file.\nGot:\n%s\nWant:\n%s", got, want)
+	}
+}
+
+func TestFindBlock(t *testing.T) {
+	tests := []struct {
+		text       string
+		start, end int
+		found, err bool
+	}{
+		{"a\nb\n", 0, 0, false, false},
+		{"a\n; BEGIN netbox2dns\nb\n; END netbox2dns\nc\n", 21, 23, true, false},
+		{"  ; BEGIN netbox2dns  \n; END netbox2dns", 23, 23, true, false},
+		{"; BEGIN netbox2dns\n", 0, 0, false, true},
+		{"; END netbox2dns\n", 0, 0, false, true},
+		{"; END netbox2dns\n; BEGIN netbox2dns\n", 0, 0, false, true},
+		{"; BEGIN netbox2dns\n; BEGIN netbox2dns\n; END netbox2dns\n", 0, 0, false, true},
+	}
+
+	for _, test := range tests {
+		start, end, found, err := findBlock([]byte(test.text))
+		if (err != nil) != test.err {
+			t.Errorf("findBlock(%q) returned error %v, want error: %v", test.text, err, test.err)
+			continue
+		}
+		if start != test.start || end != test.end || found != test.found {
+			t.Errorf("findBlock(%q): got (%d, %d, %v), want (%d, %d, %v)", test.text, start, end, found, test.start, test.end, test.found)
+		}
+	}
+}
@@ -3,11 +3,12 @@ package netbox2dns
 import (
 	"fmt"
 	"net/netip"
+	"slices"
 	"sort"
 	"strings"
+	"text/template"
 
 	log "github.com/golang/glog"
-	"github.com/scottlaird/netboxlib/netbox"
 )
 
 // ByLength is a wrapper for []string for sorting the string
@@ -25,51 +26,164 @@ func (a ByLength) Swap(i, j int) {
 }
 
 // Zones represents the set of all DNS zones known to netbox2dns.
+//
+// Naming, NameTemplate, and Hosts control how AddAddrs picks DNS
+// names for IP addresses.  When Naming.Mode is unset or "dns_name" and
+// there are no name templates, only the `dns_name` field from Netbox
+// is used and Hosts is not needed.
 type Zones struct {
-	Zones       map[string]*Zone
-	sortedZones []*Zone
+	Zones                map[string]*Zone
+	Naming               ConfigNaming
+	NameTemplate         *template.Template // From `defaults`
+	NameTemplateOverride bool
+	Hosts                *Hosts
+	Filter               *Filter   // Applies to all addresses
+	Registry             *Registry // Nil unless ownership tracking is enabled
+	Managed              *Managed  // Records that netbox2dns may remove
+	sortedZones          []*Zone
+
+	// Active IP addresses seen by AddAddrs.
+	activeAddrs map[vrfAddr]activeAddr
+}
+
+// vrfAddr is an IP address in a VRF.  The same address can be used in
+// several VRFs, with different names.
+type vrfAddr struct {
+	vrf  string
+	addr netip.Addr
+}
+
+// activeAddr records the host that an active IP address is assigned
+// to, if any, and the name used in its PTR record, or "" if it has no
+// name.
+type activeAddr struct {
+	name string
+	host *Host
 }
 
 // NewZones creates a new Zones structure and initializes it.
 func NewZones() *Zones {
 	return &Zones{
-		Zones: make(map[string]*Zone),
+		Zones:       make(map[string]*Zone),
+		Filter:      DefaultFilter(),
+		Managed:     DefaultManaged(),
+		activeAddrs: make(map[vrfAddr]activeAddr),
+	}
+}
+
+// NewZonesFromConfig creates a new Zones structure with an empty
+// Zone for each zone in the config file, along with the naming
+// settings from the config.
+func NewZonesFromConfig(cfg *Config) (*Zones, error) {
+	z := NewZones()
+	z.Naming = cfg.Naming
+
+	t, err := ParseNameTemplate("defaults", cfg.Defaults.NameTemplate)
+	if err != nil {
+		return nil, err
+	}
+	z.NameTemplate = t
+	z.NameTemplateOverride = cfg.Defaults.NameTemplateOverride
+
+	z.Filter, err = NewFilter(&cfg.Filters)
+	if err != nil {
+		return nil, err
+	}
+	z.Registry = NewRegistry(cfg.Registry)
+	z.Managed = cfg.Managed()
+
+	for _, cz := range cfg.ZoneMap {
+		err := z.NewZone(cz)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return z, nil
+}
+
+// AddRecord adds a record to the appropriate zones for an IP address
+// in the given VRF.  See FindZones for how zones are chosen.  If no
+// zones match, then an error is returned.
+func (z *Zones) AddRecord(r *Record, vrf string) error {
+	zones := z.FindZones(r.Name, vrf)
+	if len(zones) == 0 {
+		return fmt.Errorf("Can't find zone matching record %q in %v", r.Name, z.sortedZones)
 	}
+	for _, zone := range zones {
+		rc := *r
+		zone.AddRecord(&rc)
+	}
+	return nil
+}
+
+// FindZones returns the zones that should hold a DNS name for an IP
+// address in the given VRF.  Within each view, this is the zone with
+// the longest case-insensitive suffix match among zones that accept
+// the VRF, so the same name can end up in several views.  Zones
+// without `vrfs` accept addresses in every VRF.
+func (z *Zones) FindZones(name, vrf string) []*Zone {
+	zones := []*Zone{}
+	views := make(map[string]bool)
+	for _, zone := range z.sortedZones {
+		if views[zone.View] || !zone.AcceptsVRF(vrf) {
+			continue
+		}
+		if strings.HasSuffix(canonicalName(name), canonicalName(zone.Name)) {
+			zones = append(zones, zone)
+			views[zone.View] = true
+		}
+	}
+	return zones
 }
 
-// AddRecord adds a record to the appropriate zone.  It finds the
-// longest suffix match among all known zones and adds the new record
-// there.  If no zones match, then an error is returned.
-func (z *Zones) AddRecord(r *Record) error {
+// FindZone returns the zone with the longest suffix match for a DNS
+// name, or nil if no zones match.  This ignores views and VRFs.
+func (z *Zones) FindZone(name string) *Zone {
 	for _, zone := range z.sortedZones {
-		if strings.HasSuffix(r.Name, zone.Name+".") {
-			zone.AddRecord(r)
-			return nil
+		if strings.HasSuffix(canonicalName(name), canonicalName(zone.Name)) {
+			return zone
 		}
 	}
-	return fmt.Errorf("Can't find zone matching record %q in %v", r.Name, z.sortedZones)
+	return nil
 }
 
 // AddZone adds a new Zone to Zones.
 func (z *Zones) AddZone(zone *Zone) {
-	z.Zones[zone.Name] = zone
+	z.Zones[zone.Key()] = zone
 	z.sortZones()
 }
 
 // NewZone creates a new Zone in Zones using the settings in the
 // provided ConfigZone.  The resulting Zone is added to Zones
 // automatically.
-func (z *Zones) NewZone(cz *ConfigZone) {
+func (z *Zones) NewZone(cz *ConfigZone) error {
+	t, err := ParseNameTemplate(cz.Name, cz.NameTemplate)
+	if err != nil {
+		return err
+	}
+	f, err := NewFilter(cz.Filters)
+	if err != nil {
+		return fmt.Errorf("Invalid filters for zone %q: %v", cz.Name, err)
+	}
+
 	zone := Zone{
 		Name:          cz.Name,
 		ZoneName:      cz.ZoneName,
 		Project:       cz.Project,
 		Filename:      cz.Filename,
 		DeleteEntries: cz.DeleteEntries,
+		IgnoreTTL:     cz.IgnoreTTL,
 		TTL:           cz.TTL,
 		Records:       make(map[string][]*Record),
+
+		NameTemplate:         t,
+		NameTemplateOverride: cz.NameTemplateOverride,
+		Filter:               f,
+		View:                 cz.View,
+		VRFs:                 cz.VRFs,
 	}
 	z.AddZone(&zone)
+	return nil
 }
 
 // sortZones sorts zones from longest to shortest and populates `sortedZones`.
@@ -86,7 +200,8 @@ func (z *Zones) sortZones() {
 }
 
 // Compare compares two Zones structures and returns a slice of
-// ZoneDeltas showing what has changed.
+// ZoneDeltas showing what has changed.  If newer has a Registry, then
+// changes to names that it doesn't own are dropped.
 func (z *Zones) Compare(newer *Zones) []*ZoneDelta {
 	zones := make(map[string]bool)
 	deltas := []*ZoneDelta{}
@@ -102,13 +217,14 @@ func (z *Zones) Compare(newer *Zones) []*ZoneDelta {
 	for k := range zones {
 		if z.Zones[k] == nil {
 			// Only in 'newer'
-			fmt.Printf("*** Added Zone %q\n", k)
+			log.Warningf("*** Added Zone %q", k)
 		} else if newer.Zones[k] == nil {
 			// Only in 'z'
-			fmt.Printf("*** Removed Zone %q\n", k)
+			log.Warningf("*** Removed Zone %q", k)
 		} else {
 			zd := z.Zones[k].NewZoneDelta()
 			z.Zones[k].Compare(newer.Zones[k], zd)
+			newer.Registry.FilterDelta(z.Zones[k], newer.Zones[k], zd, newer.Managed)
 			deltas = append(deltas, zd)
 		}
 	}
@@ -123,16 +239,71 @@ type Zone struct {
 	Project       string
 	Filename      string
 	DeleteEntries bool
+	IgnoreTTL     bool // Records that only differ by TTL are the same
 	TTL           int64
-	Records       map[string][]*Record
+	Records       map[string][]*Record // Keyed by canonicalName
+
+	// Used when generating names for IP addresses in this zone.
+	NameTemplate         *template.Template
+	NameTemplateOverride bool
+
+	// Only addresses that match Filter get records in this zone.
+	Filter *Filter
+
+	// For split-horizon DNS.  Several zones can have the same
+	// Name as long as they're in different Views.  If VRFs is set,
+	// then only addresses in those Netbox VRFs get records in this
+	// zone; "" is the global table.
+	View string
+	VRFs []string
+}
+
+// Key returns the unique key for this zone in Zones.Zones and
+// Config.ZoneMap.
+func (z *Zone) Key() string {
+	return zoneKey(z.View, z.Name)
+}
+
+// AcceptsVRF returns true if this zone should hold records for IP
+// addresses in the given VRF.
+func (z *Zone) AcceptsVRF(vrf string) bool {
+	return len(z.VRFs) == 0 || slices.Contains(z.VRFs, vrf)
+}
+
+// zoneKey returns the key used for a zone in Zones.Zones and
+// Config.ZoneMap.  This must match the `zonemap` definition in
+// `config.cue`.
+func zoneKey(view, name string) string {
+	if view == "" {
+		return name
+	}
+	return view + "/" + name
 }
 
 // AddRecord adds a single record to this zone.  It does not check
 // that this is the correct zone for the record.
+//
+// Each name has at most one Record per type, holding the whole rrset
+// with its Rrdatas sorted and de-duplicated.  Adding a record with the
+// same name and type as an existing one merges its Rrdatas into the
+// existing Record, which keeps its TTL.  So zones built by different
+// importers, or from Netbox by AddAddrs, compare cleanly no matter how
+// their records were grouped or ordered.  Record names are converted
+// to canonicalName, so names that only differ by case or a trailing
+// dot are the same, and providers are always given the same name for
+// an rrset.
 func (z *Zone) AddRecord(r *Record) {
 	if r.TTL == 0 {
 		r.TTL = z.TTL
 	}
+	r.Name = canonicalName(r.Name)
+	for _, old := range z.Records[r.Name] {
+		if old.Type == r.Type {
+			old.merge(r)
+			return
+		}
+	}
+	r.normalize()
 	z.Records[r.Name] = append(z.Records[r.Name], r)
 }
 
@@ -159,7 +330,7 @@ func (z *Zone) Compare(newer *Zone, zd *ZoneDelta) {
 				zd.RemoveRecords[k] = z.Records[k]
 			}
 		} else {
-			CompareRecordSets(z.Records[k], newer.Records[k], zd)
+			CompareRecordSets(z.Records[k], newer.Records[k], zd, z.IgnoreTTL)
 		}
 	}
 }
@@ -169,6 +340,7 @@ func (z *Zone) Compare(newer *Zone, zd *ZoneDelta) {
 func (z *Zone) NewZoneDelta() *ZoneDelta {
 	zd := &ZoneDelta{
 		Name:          z.Name,
+		View:          z.View,
 		ZoneName:      z.ZoneName,
 		Project:       z.Project,
 		Filename:      z.Filename,
@@ -182,6 +354,7 @@ func (z *Zone) NewZoneDelta() *ZoneDelta {
 // zone.  It shows added and removed records.
 type ZoneDelta struct {
 	Name          string
+	View          string
 	ZoneName      string
 	Project       string
 	Filename      string
@@ -189,45 +362,59 @@ type ZoneDelta struct {
 	RemoveRecords map[string][]*Record
 }
 
-// CompareRecordSets compares sets of records and updates a ZoneDelta
-// with results.
-func CompareRecordSets(older []*Record, newer []*Record, zd *ZoneDelta) {
-	// So, let's start by looking for identical Records.
-
-	o := make([]string, len(older))
-	n := make([]string, len(newer))
+// Key returns the key of the zone that this delta applies to in
+// Config.ZoneMap.
+func (zd *ZoneDelta) Key() string {
+	return zoneKey(zd.View, zd.Name)
+}
 
-	for i, r := range older {
-		o[i] = fmt.Sprintf("%+v", r)
+// CompareRecordSets compares the records for a single name and
+// updates a ZoneDelta with results.  Records are matched up by type,
+// and compared with Record.Equal.  When an rrset only gains or loses
+// some rrdatas, just those rrdatas are added or removed, so the rest
+// of the rrset is left alone.  When its TTL changes, the whole rrset is
+// replaced, unless ignoreTTL is set.
+func CompareRecordSets(older []*Record, newer []*Record, zd *ZoneDelta, ignoreTTL bool) {
+	add := func(records map[string][]*Record, r *Record) {
+		name := canonicalName(r.Name)
+		records[name] = append(records[name], r)
 	}
 
-	for i, r := range newer {
-		n[i] = fmt.Sprintf("%+v", r)
+	newByType := make(map[string]*Record, len(newer))
+	for _, r := range newer {
+		newByType[r.Type] = r
 	}
-
-	// Now, let's start by removing duplicates.  These sets should
-	// be small, so O(N^2) is fine.
-	for i, r := range o {
-		for j, s := range n {
-			if r == s {
-				// Duplicate!  Remove from each set.
-				o[i] = ""
-				n[j] = ""
-			}
-		}
+	oldByType := make(map[string]*Record, len(older))
+	for _, r := range older {
+		oldByType[r.Type] = r
 	}
 
-	// At this point, any non-"" entries in o or n are actual deltas.
-	for i, r := range o {
-		if r != "" {
-			name := older[i].Name
-			zd.RemoveRecords[name] = append(zd.RemoveRecords[name], older[i])
+	for _, o := range older {
+		n := newByType[o.Type]
+		switch {
+		case n == nil:
+			add(zd.RemoveRecords, o)
+		case o.Equal(n, ignoreTTL):
+			// No change.
+		case o.TTL != n.TTL && !ignoreTTL:
+			add(zd.RemoveRecords, o)
+			add(zd.AddRecords, n)
+		default:
+			// Keep the existing TTL, since additions
+			// and removals change the whole rrset.
+			if removed := o.without(n); removed != nil {
+				add(zd.RemoveRecords, removed)
+			}
+			if added := n.without(o); added != nil {
+				added.Name = o.Name
+				added.TTL = o.TTL
+				add(zd.AddRecords, added)
+			}
 		}
 	}
-	for i, r := range n {
-		if r != "" {
-			name := newer[i].Name
-			zd.AddRecords[name] = append(zd.AddRecords[name], newer[i])
+	for _, n := range newer {
+		if oldByType[n.Type] == nil {
+			add(zd.AddRecords, n)
 		}
 	}
 }
@@ -258,33 +445,293 @@ func reverseName6(addr netip.Addr) string {
 
 // AddAddrs adds multiple addresses to a set of Zones.  This creates
 // both forward and reverse DNS entries.
-func (z *Zones) AddAddrs(addrs netbox.IPAddrs) error {
+//
+// Each address is named using its `dns_name` from Netbox and, if
+// configured, a name generated from a `name_template` or from its
+// device or VM interface.  See `config.cue` for details.
+func (z *Zones) AddAddrs(addrs IPAddrs) error {
 	for _, addr := range addrs {
-		if addr.DNSName != "" && (addr.Status == "active" || addr.Status == "dhcp") {
-			forward := Record{
-				Name:    addr.DNSName + ".",
-				Rrdatas: []string{addr.Address.Addr().String()},
+		if !z.Filter.Match(addr) {
+			continue
+		}
+		key := vrfAddr{addr.VRF, addr.Address.Addr()}
+		if _, ok := z.activeAddrs[key]; !ok {
+			active := activeAddr{}
+			if i := z.Hosts.InterfaceFor(addr); i != nil {
+				active.host = i.Host
 			}
-			reverse := Record{
-				Name:    ReverseName(addr.Address.Addr()),
-				Type:    "PTR",
-				Rrdatas: []string{addr.DNSName + "."},
+			z.activeAddrs[key] = active
+		}
+
+		mode := z.Naming.Mode
+		generated := ""
+		if t, override := z.nameTemplateFor(addr); t != nil {
+			name, err := z.TemplateName(addr, t)
+			if err != nil {
+				log.Warningf("%v", err)
 			}
-			if addr.Address.Addr().Is4() {
-				forward.Type = "A"
-			} else {
-				forward.Type = "AAAA"
+			generated = name
+			if override {
+				mode = "override"
+			} else if mode != "all" {
+				mode = "fallback"
 			}
+		} else if mode == "fallback" || mode == "all" {
+			generated = z.GeneratedName(addr)
+		}
 
-			err := z.AddRecord(&forward)
-			if err != nil {
-				return fmt.Errorf("Unable to add forward record for %q: %v", addr.DNSName, err)
+		switch mode {
+		case "override":
+			if generated != "" {
+				z.addGeneratedAddr(addr, generated, true)
+			} else if addr.DNSName != "" {
+				err := z.addAddr(addr, addr.DNSName, true)
+				if err != nil {
+					return err
+				}
 			}
-			err = z.AddRecord(&reverse)
-			if err != nil {
-				log.Warningf("Unable to add reverse record: %v", err)
+		case "fallback":
+			if addr.DNSName != "" {
+				err := z.addAddr(addr, addr.DNSName, true)
+				if err != nil {
+					return err
+				}
+			} else if generated != "" {
+				z.addGeneratedAddr(addr, generated, true)
+			}
+		case "all":
+			if addr.DNSName != "" {
+				err := z.addAddr(addr, addr.DNSName, true)
+				if err != nil {
+					return err
+				}
+			}
+			if generated != "" && generated != addr.DNSName {
+				// Only create a PTR for the generated name
+				// if there's no dns_name, otherwise we'd
+				// have two conflicting PTRs.
+				z.addGeneratedAddr(addr, generated, addr.DNSName == "")
+			}
+		default:
+			if addr.DNSName != "" {
+				err := z.addAddr(addr, addr.DNSName, true)
+				if err != nil {
+					return err
+				}
 			}
 		}
 	}
+
+	if z.Naming.PrimaryNames == "address" || z.Naming.PrimaryNames == "cname" {
+		z.addPrimaryNames()
+	}
+	for _, zone := range z.Zones {
+		z.Registry.AddRecords(zone, z.Managed)
+	}
 	return nil
 }
+
+// addGeneratedAddr adds records for a name generated from Netbox
+// devices and VMs.  These names aren't under the user's direct
+// control, so failures are logged rather than returned.
+func (z *Zones) addGeneratedAddr(addr *IPAddr, name string, ptr bool) {
+	err := z.addAddr(addr, name, ptr)
+	if err != nil {
+		log.Warningf("Unable to add generated name: %v", err)
+	}
+}
+
+// addAddr adds a forward record, and optionally a reverse record, for
+// a single IP address and name.  Records are added to every zone
+// returned by FindZones whose filter accepts the address.  If no
+// forward zone accepts it, then the reverse record is skipped too.
+func (z *Zones) addAddr(addr *IPAddr, name string, ptr bool) error {
+	forward := Record{
+		Name:    name + ".",
+		Rrdatas: []string{addr.Address.Addr().String()},
+	}
+	if addr.Address.Addr().Is4() {
+		forward.Type = "A"
+	} else {
+		forward.Type = "AAAA"
+	}
+
+	n, err := z.addAddrRecord(&forward, addr)
+	if err != nil {
+		return fmt.Errorf("Unable to add forward record for %q: %v", name, err)
+	}
+	if n == 0 {
+		return nil
+	}
+
+	if ptr {
+		key := vrfAddr{addr.VRF, addr.Address.Addr()}
+		active := z.activeAddrs[key]
+		active.name = name
+		z.activeAddrs[key] = active
+		reverse := Record{
+			Name:    ReverseName(addr.Address.Addr()),
+			Type:    "PTR",
+			Rrdatas: []string{name + "."},
+		}
+		_, err = z.addAddrRecord(&reverse, addr)
+		if err != nil {
+			log.Warningf("Unable to add reverse record: %v", err)
+		}
+	}
+	return nil
+}
+
+// addAddrRecord adds a record for an IP address to each zone returned
+// by FindZones, skipping zones whose filter rejects the address.  It
+// returns the number of zones that the record was added to.
+func (z *Zones) addAddrRecord(r *Record, addr *IPAddr) (int, error) {
+	zones := z.FindZones(r.Name, addr.VRF)
+	if len(zones) == 0 {
+		return 0, fmt.Errorf("Can't find zone matching record %q in %v", r.Name, z.sortedZones)
+	}
+
+	n := 0
+	for _, zone := range zones {
+		if !zone.Filter.Match(addr) {
+			log.V(1).Infof("Skipping %s %q for %s; filtered out of zone %q", r.Type, r.Name, addr.Address.Addr(), zone.Key())
+			continue
+		}
+		rc := *r
+		zone.AddRecord(&rc)
+		n++
+	}
+	return n, nil
+}
+
+// addPrimaryNames adds short names, like `router1.example.com`, for
+// every device and VM with an active primary IP address.  Depending
+// on `naming.primary_names`, these are either CNAMEs pointing to the
+// name of the device's primary IP address, or A/AAAA records with no
+// matching PTR.
+func (z *Zones) addPrimaryNames() {
+	if z.Hosts == nil || z.Naming.PrimaryDomain == "" {
+		return
+	}
+
+	hosts := []*Host{}
+	for _, h := range z.Hosts.Devices {
+		hosts = append(hosts, h)
+	}
+	for _, h := range z.Hosts.VMs {
+		hosts = append(hosts, h)
+	}
+
+	// Netbox doesn't say which VRF a primary address is in, so use
+	// the VRF of the active address that's assigned to the host
+	// itself.  If the same address is assigned to the host in
+	// several VRFs, then the first VRF by name wins.
+	assigned := make(map[*Host]map[netip.Addr]vrfAddr)
+	for key, active := range z.activeAddrs {
+		if active.host == nil {
+			continue
+		}
+		if assigned[active.host] == nil {
+			assigned[active.host] = make(map[netip.Addr]vrfAddr)
+		}
+		if old, ok := assigned[active.host][key.addr]; !ok || key.vrf < old.vrf {
+			assigned[active.host][key.addr] = key
+		}
+	}
+
+	for _, h := range hosts {
+		label := DNSLabel(h.Name)
+		if label == "" {
+			continue
+		}
+		name := canonicalName(label + "." + strings.Trim(z.Naming.PrimaryDomain, "."))
+
+		primaries := []vrfAddr{}
+		for _, a := range []netip.Addr{h.PrimaryIP4, h.PrimaryIP6} {
+			if !a.IsValid() {
+				continue
+			}
+			key, ok := assigned[h][a]
+			if !ok {
+				key = vrfAddr{"", a}
+				_, ok = z.activeAddrs[key]
+			}
+			if ok {
+				primaries = append(primaries, key)
+			}
+		}
+		if len(primaries) == 0 {
+			continue
+		}
+
+		zones := z.FindZones(name, primaries[0].vrf)
+		if len(zones) == 0 {
+			log.Warningf("Can't find zone matching primary name %q", name)
+			continue
+		}
+
+		for _, zone := range zones {
+			if z.Naming.PrimaryNames == "cname" {
+				z.addPrimaryCNAME(zone, name, primaries)
+			} else {
+				z.addPrimaryAddrs(zone, name, primaries)
+			}
+		}
+	}
+}
+
+// addPrimaryCNAME adds a CNAME from name, which must be a
+// canonicalName, to the name of the first primary address that has
+// one, preferring IPv4.
+func (z *Zones) addPrimaryCNAME(zone *Zone, name string, primaries []vrfAddr) {
+	target := ""
+	for _, a := range primaries {
+		if z.activeAddrs[a].name != "" {
+			target = z.activeAddrs[a].name + "."
+			break
+		}
+	}
+	if target == "" || canonicalName(target) == name {
+		return
+	}
+	// CNAMEs can't coexist with other records.
+	if len(zone.Records[name]) > 0 {
+		log.Warningf("Not adding CNAME for %q; it already has other records", name)
+		return
+	}
+	zone.AddRecord(&Record{
+		Name:    name,
+		Type:    "CNAME",
+		Rrdatas: []string{target},
+	})
+}
+
+// addPrimaryAddrs adds A and AAAA records for name pointing at each
+// primary address.
+func (z *Zones) addPrimaryAddrs(zone *Zone, name string, primaries []vrfAddr) {
+	for _, a := range primaries {
+		r := &Record{
+			Name:    name,
+			Type:    "A",
+			Rrdatas: []string{a.addr.String()},
+		}
+		if a.addr.Is6() {
+			r.Type = "AAAA"
+		}
+		if hasRecord(zone.Records[name], r) {
+			continue
+		}
+		zone.AddRecord(r)
+	}
+}
+
+// hasRecord returns true if records already contains a record with
+// the same type as r and all of r's rrdatas.
+func hasRecord(records []*Record, r *Record) bool {
+	for _, old := range records {
+		if old.Type == r.Type {
+			return r.without(old) == nil
+		}
+	}
+	return false
+}
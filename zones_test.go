@@ -1,7 +1,9 @@
 package netbox2dns
 
 import (
+	"fmt"
 	"net/netip"
+	"strings"
 	"testing"
 )
 
@@ -82,3 +84,438 @@ func TestReverseName6(t *testing.T) {
 		t.Errorf("ReverseName(%s) wrong, got %q want %q", addr.String(), got, want)
 	}
 }
+
+// testHosts returns a Hosts with one device and one VM, each with a
+// single interface.
+func testHosts() *Hosts {
+	hosts := NewHosts()
+	hosts.Devices[1] = &Host{ID: 1, Name: "router1", Site: "sea1"}
+	hosts.VMs[2] = &Host{ID: 2, Name: "web1", IsVM: true, Cluster: "prod"}
+	hosts.Interfaces[10] = &Interface{ID: 10, Name: "xe-0/0/0.100", Host: hosts.Devices[1]}
+	hosts.VMInterfaces[20] = &Interface{ID: 20, Name: "eth0", Host: hosts.VMs[2]}
+	return hosts
+}
+
+func testZones(naming ConfigNaming) *Zones {
+	z := NewZones()
+	z.Naming = naming
+	z.Hosts = testHosts()
+	for _, name := range []string{"example.com", "10.in-addr.arpa"} {
+		z.NewZone(&ConfigZone{Name: name, TTL: 300})
+	}
+	return z
+}
+
+func TestAddAddrsGeneratedNames(t *testing.T) {
+	addrs := IPAddrs{
+		{Address: netip.MustParsePrefix("10.0.0.1/24"), Status: "active", AssignedObjectType: "dcim.interface", AssignedObjectID: 10},
+		{Address: netip.MustParsePrefix("10.0.0.2/24"), Status: "active", AssignedObjectType: "virtualization.vminterface", AssignedObjectID: 20, DNSName: "www.example.com"},
+		{Address: netip.MustParsePrefix("10.0.0.3/24"), Status: "active", DNSName: "printer.example.com"},
+		{Address: netip.MustParsePrefix("10.0.0.4/24"), Status: "deprecated", AssignedObjectType: "dcim.interface", AssignedObjectID: 10},
+	}
+	naming := ConfigNaming{DeviceDomain: "example.com", VMDomain: "vm.example.com."}
+
+	tests := []struct {
+		mode    string
+		forward []string
+		ptr     map[string]string
+	}{
+		{
+			mode:    "dns_name",
+			forward: []string{"www.example.com.", "printer.example.com."},
+			ptr: map[string]string{
+				"2.0.0.10.in-addr.arpa.": "www.example.com.",
+				"3.0.0.10.in-addr.arpa.": "printer.example.com.",
+			},
+		},
+		{
+			mode:    "fallback",
+			forward: []string{"xe-0-0-0-100.router1.sea1.example.com.", "www.example.com.", "printer.example.com."},
+			ptr: map[string]string{
+				"1.0.0.10.in-addr.arpa.": "xe-0-0-0-100.router1.sea1.example.com.",
+				"2.0.0.10.in-addr.arpa.": "www.example.com.",
+				"3.0.0.10.in-addr.arpa.": "printer.example.com.",
+			},
+		},
+		{
+			mode:    "all",
+			forward: []string{"xe-0-0-0-100.router1.sea1.example.com.", "www.example.com.", "web1.prod.vm.example.com.", "printer.example.com."},
+			ptr: map[string]string{
+				"1.0.0.10.in-addr.arpa.": "xe-0-0-0-100.router1.sea1.example.com.",
+				"2.0.0.10.in-addr.arpa.": "www.example.com.",
+				"3.0.0.10.in-addr.arpa.": "printer.example.com.",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		naming.Mode = test.mode
+		z := testZones(naming)
+		err := z.AddAddrs(addrs)
+		if err != nil {
+			t.Fatalf("AddAddrs(%s) returned error: %v", test.mode, err)
+		}
+
+		fwd := z.Zones["example.com"].Records
+		if len(fwd) != len(test.forward) {
+			t.Errorf("AddAddrs(%s): got %d forward names, want %d: %v", test.mode, len(fwd), len(test.forward), fwd)
+		}
+		for _, name := range test.forward {
+			if fwd[name] == nil {
+				t.Errorf("AddAddrs(%s): missing forward record for %q", test.mode, name)
+			}
+		}
+
+		rev := z.Zones["10.in-addr.arpa"].Records
+		if len(rev) != len(test.ptr) {
+			t.Errorf("AddAddrs(%s): got %d PTR names, want %d", test.mode, len(rev), len(test.ptr))
+		}
+		for name, want := range test.ptr {
+			r := rev[name]
+			if len(r) != 1 || r[0].Rrdatas[0] != want {
+				t.Errorf("AddAddrs(%s): PTR for %q: got %+v, want %q", test.mode, name, r, want)
+			}
+		}
+	}
+}
+
+func TestAddAddrsPrimaryNames(t *testing.T) {
+	addrs := IPAddrs{
+		{Address: netip.MustParsePrefix("10.0.0.1/24"), Status: "active", AssignedObjectType: "dcim.interface", AssignedObjectID: 10},
+		{Address: netip.MustParsePrefix("10.0.0.2/24"), Status: "active", AssignedObjectType: "virtualization.vminterface", AssignedObjectID: 20, DNSName: "www.example.com"},
+	}
+	naming := ConfigNaming{
+		Mode:          "fallback",
+		DeviceDomain:  "example.com",
+		PrimaryDomain: "example.com",
+	}
+
+	tests := []struct {
+		mode  string
+		name  string
+		rtype string
+		want  string
+	}{
+		{"cname", "router1.example.com.", "CNAME", "xe-0-0-0-100.router1.sea1.example.com."},
+		{"cname", "web1.example.com.", "CNAME", "www.example.com."},
+		{"address", "router1.example.com.", "A", "10.0.0.1"},
+		{"address", "web1.example.com.", "A", "10.0.0.2"},
+	}
+
+	for _, test := range tests {
+		naming.PrimaryNames = test.mode
+		z := testZones(naming)
+		z.Hosts.Devices[1].PrimaryIP4 = netip.MustParseAddr("10.0.0.1")
+		z.Hosts.VMs[2].PrimaryIP4 = netip.MustParseAddr("10.0.0.2")
+		err := z.AddAddrs(addrs)
+		if err != nil {
+			t.Fatalf("AddAddrs(%s) returned error: %v", test.mode, err)
+		}
+
+		r := z.Zones["example.com"].Records[test.name]
+		if len(r) != 1 || r[0].Type != test.rtype || r[0].Rrdatas[0] != test.want {
+			t.Errorf("AddAddrs(%s): record for %q: got %+v, want %s %q", test.mode, test.name, r, test.rtype, test.want)
+		}
+
+		// Primary names never get PTR records.
+		if len(z.Zones["10.in-addr.arpa"].Records) != 2 {
+			t.Errorf("AddAddrs(%s): got %d PTR names, want 2", test.mode, len(z.Zones["10.in-addr.arpa"].Records))
+		}
+	}
+}
+
+func TestAddAddrsPrimaryNamesCase(t *testing.T) {
+	naming := ConfigNaming{
+		PrimaryDomain: "Example.COM",
+		PrimaryNames:  "cname",
+	}
+
+	tests := []struct {
+		name  string
+		addrs IPAddrs
+		want  string // Types for router1.example.com.
+	}{
+		{
+			// router1.example.com already has an A record, so
+			// it can't have a CNAME too.
+			name: "existing records",
+			addrs: IPAddrs{
+				{Address: netip.MustParsePrefix("10.0.0.1/24"), Status: "active", AssignedObjectType: "dcim.interface", AssignedObjectID: 10, DNSName: "www.example.com"},
+				{Address: netip.MustParsePrefix("10.0.0.9/24"), Status: "active", DNSName: "router1.example.com"},
+			},
+			want: "A",
+		},
+		{
+			// The primary address is already named
+			// router1.example.com, so no CNAME is needed.
+			name: "same name",
+			addrs: IPAddrs{
+				{Address: netip.MustParsePrefix("10.0.0.1/24"), Status: "active", AssignedObjectType: "dcim.interface", AssignedObjectID: 10, DNSName: "Router1.example.com"},
+			},
+			want: "A",
+		},
+	}
+
+	for _, test := range tests {
+		z := testZones(naming)
+		z.Hosts.Devices[1].PrimaryIP4 = netip.MustParseAddr("10.0.0.1")
+		err := z.AddAddrs(test.addrs)
+		if err != nil {
+			t.Fatalf("AddAddrs(%s) returned error: %v", test.name, err)
+		}
+
+		types := []string{}
+		for _, r := range z.Zones["example.com"].Records["router1.example.com."] {
+			types = append(types, r.Type)
+		}
+		if strings.Join(types, " ") != test.want {
+			t.Errorf("AddAddrs(%s): got %v for router1.example.com., want %s", test.name, types, test.want)
+		}
+	}
+}
+
+func TestAddAddrsPrimaryNamesVRFs(t *testing.T) {
+	// 10.0.0.1 is router1's primary address in the global table, and
+	// lab1's primary address in the lab VRF.
+	addrs := IPAddrs{
+		{Address: netip.MustParsePrefix("10.0.0.1/24"), Status: "active", AssignedObjectType: "dcim.interface", AssignedObjectID: 10, DNSName: "gw.example.com"},
+		{Address: netip.MustParsePrefix("10.0.0.1/24"), Status: "active", AssignedObjectType: "dcim.interface", AssignedObjectID: 30, DNSName: "lab-gw.example.com", VRF: "lab"},
+	}
+
+	tests := []struct {
+		mode  string
+		rtype string
+		want  map[string]map[string]string // Zone -> name -> rrdata
+	}{
+		{"cname", "CNAME", map[string]map[string]string{
+			"example.com":     {"router1.example.com.": "gw.example.com."},
+			"lab/example.com": {"lab1.example.com.": "lab-gw.example.com."},
+		}},
+		{"address", "A", map[string]map[string]string{
+			"example.com":     {"router1.example.com.": "10.0.0.1"},
+			"lab/example.com": {"lab1.example.com.": "10.0.0.1"},
+		}},
+	}
+
+	for _, test := range tests {
+		z := NewZones()
+		z.Naming = ConfigNaming{PrimaryDomain: "example.com", PrimaryNames: test.mode}
+		z.Hosts = testHosts()
+		z.Hosts.Devices[1].PrimaryIP4 = netip.MustParseAddr("10.0.0.1")
+		z.Hosts.Devices[3] = &Host{ID: 3, Name: "lab1", Site: "lab1", PrimaryIP4: netip.MustParseAddr("10.0.0.1")}
+		z.Hosts.Interfaces[30] = &Interface{ID: 30, Name: "eth0", Host: z.Hosts.Devices[3]}
+		for _, view := range []string{"", "lab"} {
+			for _, name := range []string{"example.com", "10.in-addr.arpa"} {
+				z.NewZone(&ConfigZone{Name: name, TTL: 300, View: view, VRFs: []string{view}})
+			}
+		}
+
+		err := z.AddAddrs(addrs)
+		if err != nil {
+			t.Fatalf("AddAddrs(%s) returned error: %v", test.mode, err)
+		}
+
+		for zone, names := range test.want {
+			for name, want := range names {
+				r := z.Zones[zone].Records[name]
+				if len(r) != 1 || r[0].Type != test.rtype || len(r[0].Rrdatas) != 1 || r[0].Rrdatas[0] != want {
+					t.Errorf("AddAddrs(%s): zone %q record for %q: got %+v, want %s %q", test.mode, zone, name, r, test.rtype, want)
+				}
+			}
+			// Each host's primary name only shows up in its own view.
+			if len(z.Zones[zone].Records) != 2 {
+				t.Errorf("AddAddrs(%s): zone %q: got %v, want 2 names", test.mode, zone, z.Zones[zone].Records)
+			}
+		}
+	}
+}
+
+func TestAddAddrsZoneFilters(t *testing.T) {
+	addrs := IPAddrs{
+		{Address: netip.MustParsePrefix("10.0.0.1/24"), Status: "active", DNSName: "a.example.com", VRF: "lab"},
+		{Address: netip.MustParsePrefix("10.0.0.2/24"), Status: "active", DNSName: "b.example.com"},
+		{Address: netip.MustParsePrefix("10.0.0.3/24"), Status: "active", DNSName: "c.example.com", Tags: map[string]bool{"noptr": true}},
+	}
+
+	z := NewZones()
+	z.NewZone(&ConfigZone{Name: "example.com", TTL: 300, Filters: &ConfigFilter{ExcludeVRFs: []string{"lab"}}})
+	z.NewZone(&ConfigZone{Name: "10.in-addr.arpa", TTL: 300, Filters: &ConfigFilter{ExcludeTags: []string{"noptr"}}})
+
+	err := z.AddAddrs(addrs)
+	if err != nil {
+		t.Fatalf("AddAddrs() returned error: %v", err)
+	}
+
+	fwd := z.Zones["example.com"].Records
+	if fwd["a.example.com."] != nil {
+		t.Errorf("a.example.com was added, but its VRF is excluded")
+	}
+	if fwd["b.example.com."] == nil || fwd["c.example.com."] == nil {
+		t.Errorf("missing forward records: %v", fwd)
+	}
+
+	rev := z.Zones["10.in-addr.arpa"].Records
+	if len(rev) != 1 || rev["2.0.0.10.in-addr.arpa."] == nil {
+		t.Errorf("wrong PTR records; got %v want only 2.0.0.10.in-addr.arpa.", rev)
+	}
+}
+
+func TestAddAddrsViews(t *testing.T) {
+	addrs := IPAddrs{
+		{Address: netip.MustParsePrefix("10.0.0.1/24"), Status: "active", DNSName: "a.example.com"},
+		{Address: netip.MustParsePrefix("10.0.0.1/24"), Status: "active", DNSName: "a.lab.example.com", VRF: "lab"},
+		{Address: netip.MustParsePrefix("10.0.0.2/24"), Status: "active", DNSName: "b.example.com", VRF: "other"},
+	}
+
+	z := NewZones()
+	z.NewZone(&ConfigZone{Name: "example.com", TTL: 300})
+	z.NewZone(&ConfigZone{Name: "10.in-addr.arpa", TTL: 300, VRFs: []string{""}})
+	z.NewZone(&ConfigZone{Name: "10.in-addr.arpa", TTL: 300, View: "lab", VRFs: []string{"lab"}})
+
+	err := z.AddAddrs(addrs)
+	if err != nil {
+		t.Fatalf("AddAddrs() returned error: %v", err)
+	}
+
+	if len(z.Zones["example.com"].Records) != 3 {
+		t.Errorf("wrong forward records; got %v want 3 names", z.Zones["example.com"].Records)
+	}
+
+	tests := []struct {
+		zone string
+		want string
+	}{
+		{"10.in-addr.arpa", "a.example.com."},
+		{"lab/10.in-addr.arpa", "a.lab.example.com."},
+	}
+	for _, test := range tests {
+		rev := z.Zones[test.zone].Records
+		r := rev["1.0.0.10.in-addr.arpa."]
+		if len(rev) != 1 || len(r) != 1 || r[0].Rrdatas[0] != test.want {
+			t.Errorf("zone %q: got %v, want only a PTR to %q", test.zone, rev, test.want)
+		}
+	}
+}
+
+func TestAddAddrsRrsets(t *testing.T) {
+	addrs := IPAddrs{
+		{Address: netip.MustParsePrefix("10.0.0.2/24"), Status: "active", DNSName: "multi.example.com"},
+		{Address: netip.MustParsePrefix("10.0.0.1/24"), Status: "active", DNSName: "multi.example.com"},
+		{Address: netip.MustParsePrefix("10.0.0.1/24"), Status: "active", DNSName: "multi.example.com"},
+		{Address: netip.MustParsePrefix("10.0.0.3/24"), Status: "active", DNSName: "single.example.com"},
+	}
+
+	z := testZones(ConfigNaming{})
+	err := z.AddAddrs(addrs)
+	if err != nil {
+		t.Fatalf("AddAddrs() returned error: %v", err)
+	}
+
+	r := z.Zones["example.com"].Records["multi.example.com."]
+	if len(r) != 1 || fmt.Sprint(r[0].Rrdatas) != "[10.0.0.1 10.0.0.2]" {
+		t.Errorf("AddAddrs() didn't build a single sorted rrset; got %+v", r)
+	}
+
+	// The same rrsets, grouped and ordered differently, as an
+	// importer might return them.
+	imported := &Zone{Name: "example.com", TTL: 300, DeleteEntries: true, Records: make(map[string][]*Record)}
+	for _, r := range []*Record{
+		{Name: "multi.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.2"}},
+		{Name: "single.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.3"}},
+		{Name: "multi.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.1", "10.0.0.2"}},
+	} {
+		imported.AddRecord(r)
+	}
+
+	zd := imported.NewZoneDelta()
+	imported.Compare(z.Zones["example.com"], zd)
+	if len(zd.AddRecords) != 0 || len(zd.RemoveRecords) != 0 {
+		t.Errorf("Compare() of matching rrsets found changes: add %v, remove %v", zd.AddRecords, zd.RemoveRecords)
+	}
+}
+
+func TestCompareRecordSets(t *testing.T) {
+	tests := []struct {
+		name      string
+		older     []*Record
+		newer     []*Record
+		ignoreTTL bool
+		want      string
+	}{
+		{
+			name:  "case and trailing dot",
+			older: []*Record{{Name: "Host.Example.com.", Type: "PTR", TTL: 300, Rrdatas: []string{"WWW.example.com."}}},
+			newer: []*Record{{Name: "host.example.com", Type: "PTR", TTL: 300, Rrdatas: []string{"www.example.com"}}},
+			want:  "",
+		},
+		{
+			name:  "IPv6 forms",
+			older: []*Record{{Name: "host.example.com.", Type: "AAAA", TTL: 300, Rrdatas: []string{"2001:DB8:0:0::1", "::1"}}},
+			newer: []*Record{{Name: "host.example.com.", Type: "AAAA", TTL: 300, Rrdatas: []string{"0:0::1", "2001:db8::1"}}},
+			want:  "",
+		},
+		{
+			name:  "TTL",
+			older: []*Record{{Name: "host.example.com.", Type: "A", TTL: 600, Rrdatas: []string{"10.0.0.1"}}},
+			newer: []*Record{{Name: "host.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.1"}}},
+			want:  "- host.example.com. A 600 [10.0.0.1]; + host.example.com. A 300 [10.0.0.1]",
+		},
+		{
+			name:      "ignored TTL",
+			older:     []*Record{{Name: "host.example.com.", Type: "A", TTL: 600, Rrdatas: []string{"10.0.0.1"}}},
+			newer:     []*Record{{Name: "host.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.1"}}},
+			ignoreTTL: true,
+			want:      "",
+		},
+		{
+			name:      "ignored TTL with a new address",
+			older:     []*Record{{Name: "host.example.com.", Type: "A", TTL: 600, Rrdatas: []string{"10.0.0.1"}}},
+			newer:     []*Record{{Name: "host.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.1", "10.0.0.2"}}},
+			ignoreTTL: true,
+			want:      "+ host.example.com. A 600 [10.0.0.2]",
+		},
+		{
+			name: "partial rrset",
+			older: []*Record{
+				{Name: "host.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.1", "10.0.0.2"}},
+				{Name: "host.example.com.", Type: "TXT", TTL: 300, Rrdatas: []string{`"hello"`}},
+			},
+			newer: []*Record{
+				{Name: "host.example.com.", Type: "A", TTL: 300, Rrdatas: []string{"10.0.0.1", "10.0.0.3"}},
+				{Name: "host.example.com.", Type: "AAAA", TTL: 300, Rrdatas: []string{"2001:db8::1"}},
+			},
+			want: "- host.example.com. A 300 [10.0.0.2]; - host.example.com. TXT 300 [\"hello\"]; + host.example.com. A 300 [10.0.0.3]; + host.example.com. AAAA 300 [2001:db8::1]",
+		},
+	}
+
+	for _, test := range tests {
+		older := &Zone{Name: "example.com", Records: make(map[string][]*Record)}
+		for _, r := range test.older {
+			older.AddRecord(r)
+		}
+		newer := &Zone{Name: "example.com", Records: make(map[string][]*Record)}
+		for _, r := range test.newer {
+			newer.AddRecord(r)
+		}
+
+		zd := older.NewZoneDelta()
+		for name := range older.Records {
+			CompareRecordSets(older.Records[name], newer.Records[name], zd, test.ignoreTTL)
+		}
+
+		got := []string{}
+		for _, records := range []struct {
+			prefix string
+			rs     map[string][]*Record
+		}{{"-", zd.RemoveRecords}, {"+", zd.AddRecords}} {
+			for _, rs := range records.rs {
+				for _, r := range rs {
+					got = append(got, fmt.Sprintf("%s %s %s %d %v", records.prefix, r.Name, r.Type, r.TTL, r.Rrdatas))
+				}
+			}
+		}
+		if strings.Join(got, "; ") != test.want {
+			t.Errorf("%s: CompareRecordSets() wrong;\n got %s\nwant %s", test.name, strings.Join(got, "; "), test.want)
+		}
+	}
+}